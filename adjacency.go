@@ -0,0 +1,164 @@
+package main
+
+import "fmt"
+
+// Sources of the adjacency rules of the simple model. Edges matches
+// the pixels at the tile borders, sample only allows tiles next to each
+// other which are  neighbors in the example  level, both requires both.
+const (
+	RulesEdges  = "edges"
+	RulesSample = "sample"
+	RulesBoth   = "both"
+)
+
+var Rules = []string{RulesEdges, RulesSample, RulesBoth}
+
+// The adjacency index holds for each tile index and direction the
+// set  of tile  indices  which are  allowed to  be placed  next to
+// it. It is being built  once after the superposition has been setup
+// and used by all slots during propagation.
+type Adjacency struct {
+	Rules  [][4]Bitset
+	Counts [][4][]int // learned from the sample: how often each pair occurred
+}
+
+// Return a new empty index for count tiles
+func NewAdjacency(count int) *Adjacency {
+	adjacency := &Adjacency{Rules: make([][4]Bitset, count)}
+
+	for tile := range adjacency.Rules {
+		for _, direction := range Directions {
+			adjacency.Rules[tile][direction] = NewBitset(count)
+		}
+	}
+
+	return adjacency
+}
+
+/*
+Build the index from the edge constraints of the tiles. If the side of
+a tile pointing towards the other tile matches the adversial side of
+the other tile, they are compatible in that direction.
+
+	 ----        ----
+	|    |  =>  |    |
+	 ----        ----
+
+tile.dir     other.adverse
+
+	east   =>  west
+*/
+func NewAdjacencyFromConstraints(superposition Superposition) *Adjacency {
+	adjacency := NewAdjacency(len(superposition))
+
+	for _, tile := range superposition {
+		for _, direction := range Directions {
+			adversedirection := GetAdverseDir(direction)
+
+			for _, other := range superposition {
+				if tile.Constraints[direction] == other.Constraints[adversedirection] {
+					adjacency.Rules[tile.Index][direction].Set(other.Index)
+				}
+			}
+		}
+	}
+
+	return adjacency
+}
+
+// Build the index  from the example level: tiles are only allowed next
+// to each other if they are neighbors somewhere in the sample. Also counts
+// how often each pair occurs.
+func NewAdjacencyFromSample(sample *Sample, count int) *Adjacency {
+	adjacency := NewAdjacency(count)
+	adjacency.Counts = make([][4][]int, count)
+
+	for tile := range adjacency.Counts {
+		for _, direction := range Directions {
+			adjacency.Counts[tile][direction] = make([]int, count)
+		}
+	}
+
+	for y := 0; y < sample.Height; y++ {
+		for x := 0; x < sample.Width; x++ {
+			tile := sample.At(x, y)
+			if tile < 0 {
+				continue
+			}
+
+			// looking east and south is enough, Allow() takes care of
+			// the adverse directions
+			for _, direction := range []Direction{East, South} {
+				point := (&Point{X: x, Y: y}).MoveDirection(direction)
+
+				other := sample.At(point.X, point.Y)
+				if other < 0 {
+					continue
+				}
+
+				adjacency.Allow(tile, direction, other)
+				adjacency.Counts[tile][direction][other]++
+				adjacency.Counts[other][GetAdverseDir(direction)][tile]++
+			}
+		}
+	}
+
+	return adjacency
+}
+
+// Only keep the rules which are allowed by other as well
+func (adjacency *Adjacency) Intersect(other *Adjacency) {
+	for tile, rules := range adjacency.Rules {
+		for _, direction := range Directions {
+			rules[direction].And(other.Rules[tile][direction])
+		}
+	}
+}
+
+// Allow other to be placed next to tile in the given direction, and
+// thus tile next to other in the adverse direction.
+func (adjacency *Adjacency) Allow(tile int, direction Direction, other int) {
+	adjacency.Rules[tile][direction].Set(other)
+	adjacency.Rules[other][GetAdverseDir(direction)].Set(tile)
+}
+
+// Return the indices of all tiles allowed next to tile in direction
+func (adjacency *Adjacency) Compatible(tile int, direction Direction) Bitset {
+	return adjacency.Rules[tile][direction]
+}
+
+// Store into supported all tiles which are allowed in the given
+// direction by at least one of the given tiles
+func (adjacency *Adjacency) Supported(tiles Bitset, direction Direction, supported Bitset) {
+	supported.Reset()
+
+	for index := tiles.Next(0); index >= 0; index = tiles.Next(index + 1) {
+		supported.Or(adjacency.Rules[index][direction])
+	}
+}
+
+// Print the index (tile index + compatible tiles per direction), if
+// learned from the sample, each compatible tile is followed by the
+// number of occurrences, e.g. 5x3
+func (adjacency *Adjacency) Dump() {
+	for tile, rules := range adjacency.Rules {
+		sides := make([]string, 4)
+
+		for _, direction := range Directions {
+			sides[direction] = rules[direction].String()
+
+			if adjacency.Counts != nil {
+				pairs := []string{}
+				for _, other := range rules[direction].Indices() {
+					pairs = append(pairs, fmt.Sprintf("%dx%d", other,
+						adjacency.Counts[tile][direction][other]))
+				}
+
+				sides[direction] = fmt.Sprint(pairs)
+			}
+		}
+
+		fmt.Printf("  %3d: N:%s E:%s S:%s W:%s\n",
+			tile, sides[North], sides[East], sides[South], sides[West])
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Settings of the test runs of the analyzer
+const (
+	AnalyzeSize    = 16              // width and height of the test map
+	AnalyzeTries   = 3               // test maps per setting, each with another seed
+	AnalyzeTimeout = 2 * time.Second // per test map
+)
+
+// Result of one edge matcher setting
+type Analysis struct {
+	Edges   EdgeMatcher
+	Classes int // number of distinct edges
+	Dead    int // tiles without any compatible neighbor on at least one side
+	Solved  int // number of solved test maps
+}
+
+// Return all settings to try: each sampling strategy with 1-8 samples,
+// tolerance, distance and alpha handling are taken from base
+func AnalyzeCandidates(base EdgeMatcher) []EdgeMatcher {
+	candidates := []EdgeMatcher{}
+
+	for _, strategy := range []string{EdgesPoints, EdgesSegments} {
+		for checkpoints := 1; checkpoints <= 8; checkpoints++ {
+			candidate := base
+			candidate.Strategy = strategy
+			candidate.Checkpoints = checkpoints
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	full := base
+	full.Strategy = EdgesFull
+
+	return append(candidates, full)
+}
+
+// Try all  candidate settings on  the example level: count  the edge
+// classes and dead tiles and try to solve a couple of small test maps.
+// The project is loaded once, only the constraints and the adjacency
+// are rebuilt for each setting.
+func Analyze(ctx context.Context, projectname, level string, model Model, seed int64) ([]Analysis, error) {
+	if model.Name != ModelSimple || model.Rules == RulesSample {
+		return nil, errors.New("only the simple model using edge rules can be analyzed")
+	}
+
+	wave, err := NewWaveFromProject(projectname, level, "",
+		AnalyzeSize, AnalyzeSize, model.Edges.Checkpoints, model)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wave.Superposition) > 0 && wave.Superposition[0].Sockets {
+		return nil, errors.New("the tiles use sockets, edges are not being compared")
+	}
+
+	wave.Timeout = AnalyzeTimeout
+	wave.OutputTilemap.Quiet = true
+
+	results := []Analysis{}
+
+	for _, edges := range AnalyzeCandidates(model.Edges) {
+		if err := wave.SetEdgeMatcher(edges); err != nil {
+			return nil, err
+		}
+
+		analysis := Analysis{Edges: edges}
+		analysis.Classes, analysis.Dead = wave.EdgeStats()
+
+		for try := 0; try < AnalyzeTries; try++ {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("analysis cancelled: %w", err)
+			}
+
+			// every test map starts from scratch
+			if try > 0 {
+				wave.OutputTilemap.Populate(wave.Superposition)
+			}
+
+			wave.SetSeed(DeriveSeed(seed, try))
+
+			if wave.CollapseContext(ctx) == nil {
+				analysis.Solved++
+			}
+		}
+
+		results = append(results, analysis)
+	}
+
+	return results, nil
+}
+
+// Return the number of distinct edges  and the number of tiles which
+// have no compatible neighbor on at least one side
+func (wave *Wave) EdgeStats() (int, int) {
+	classes := map[string]bool{}
+	dead := 0
+
+	for _, tile := range wave.Superposition {
+		for _, constraint := range tile.Constraints {
+			classes[constraint] = true
+		}
+
+		for _, direction := range Directions {
+			if wave.Adjacency.Compatible(tile.Index, direction).Count() == 0 {
+				dead++
+				break
+			}
+		}
+	}
+
+	return len(classes), dead
+}
+
+// Return true if a is a better setting  than b: more solved test maps
+// first, then fewer dead tiles, then more edge classes (the finer the
+// classes, the fewer tiles match by accident), then fewer samples.
+func (a Analysis) Better(b Analysis) bool {
+	switch {
+	case a.Solved != b.Solved:
+		return a.Solved > b.Solved
+	case a.Dead != b.Dead:
+		return a.Dead < b.Dead
+	case a.Classes != b.Classes:
+		return a.Classes > b.Classes
+	}
+
+	return a.Edges.Checkpoints < b.Edges.Checkpoints
+}
+
+// Return the best of the given results
+func BestAnalysis(results []Analysis) Analysis {
+	best := results[0]
+
+	for _, analysis := range results[1:] {
+		if analysis.Better(best) {
+			best = analysis
+		}
+	}
+
+	return best
+}
+
+// Print the results as a table and the recommended setting
+func PrintAnalysis(output io.Writer, results []Analysis) {
+	best := BestAnalysis(results)
+
+	fmt.Fprintf(output, "%-10s %11s %7s %10s %7s\n", "strategy", "checkpoints", "classes", "dead tiles", "solved")
+
+	for _, analysis := range results {
+		marker := ""
+		if analysis == best {
+			marker = " <="
+		}
+
+		checkpoints := fmt.Sprint(analysis.Edges.Checkpoints)
+		if analysis.Edges.Strategy == EdgesFull {
+			checkpoints = "-"
+		}
+
+		fmt.Fprintf(output, "%-10s %11s %7d %10d %4d/%d%s\n",
+			analysis.Edges.Strategy, checkpoints, analysis.Classes,
+			analysis.Dead, analysis.Solved, AnalyzeTries, marker)
+	}
+
+	fmt.Fprintf(output, "\nrecommended: --edges %s", best.Edges.Strategy)
+	if best.Edges.Strategy != EdgesFull {
+		fmt.Fprintf(output, " --checkpoints %d", best.Edges.Checkpoints)
+	}
+	fmt.Fprintln(output)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Strategies  to  handle  contradictions  during  collapse.  Restart
+// just restores  the state  before the last  round and  tries again,
+// backtrack  keeps a stack of  all decisions and unwinds  as many of
+// them as needed, banning the tiles which led to the contradiction.
+const (
+	StrategyBacktrack = "backtrack"
+	StrategyRestart   = "restart"
+)
+
+var Strategies = []string{StrategyBacktrack, StrategyRestart}
+
+// Returned if backtracking ran out of decisions to undo, which means
+// there's no solution at all
+var ErrUnsatisfiable = errors.New("tilemap cannot be collapsed")
+
+// One decision of the solver: the slot has been collapsed to the tile
+// with the given index. Mark is the length of the trail before the
+// decision has been made, everything above it belongs to it.
+type Decision struct {
+	Slot *Slot
+	Tile int
+	Mark int
+}
+
+// Undo record: the possible tiles of the slot before it got changed
+type Undo struct {
+	Slot  *Slot
+	Tiles Bitset
+}
+
+// check if the given strategy is known
+func CheckStrategy(strategy string) error {
+	if !Contains(Strategies, strategy) {
+		return fmt.Errorf("unknown strategy %q, expected one of %v", strategy, Strategies)
+	}
+
+	return nil
+}
+
+// Remember  the  previous  tiles of  the given  slot, so  that the
+// current decision can  be undone. Every slot is only saved once per
+// decision. Changes made before the first decision can't be undone
+// anyway, so they are not recorded.
+func (tilemap *Tilemap) Save(slot *Slot, previous Bitset) {
+	if len(tilemap.Decisions) == 0 || slot.Epoch == tilemap.Epoch {
+		return
+	}
+
+	tilemap.Trail = append(tilemap.Trail, Undo{Slot: slot, Tiles: previous.Copy()})
+	slot.Epoch = tilemap.Epoch
+}
+
+// Collapse the given slot to the given tile and push the decision
+func (tilemap *Tilemap) Decide(slot *Slot, tile int) {
+	tilemap.Decisions = append(tilemap.Decisions, Decision{
+		Slot: slot,
+		Tile: tile,
+		Mark: len(tilemap.Trail),
+	})
+	tilemap.Epoch++
+
+	tilemap.Save(slot, slot.PossibleTiles)
+	slot.CollapseTo(tile)
+	slot.Priority = tilemap.Priority(slot)
+	tilemap.Remember(slot, tile, false)
+}
+
+// Undo the  last decision: restore  all slots changed by it  and pop
+// it from the stack. Returns the undone decision.
+func (tilemap *Tilemap) Undo() Decision {
+	decision := tilemap.Decisions[len(tilemap.Decisions)-1]
+	tilemap.Decisions = tilemap.Decisions[:len(tilemap.Decisions)-1]
+
+	for i := len(tilemap.Trail) - 1; i >= decision.Mark; i-- {
+		undo := tilemap.Trail[i]
+		undo.Slot.PossibleTiles.CopyFrom(undo.Tiles)
+		undo.Slot.Priority = tilemap.Priority(undo.Slot)
+	}
+
+	tilemap.Trail = tilemap.Trail[:decision.Mark]
+
+	// the parent decision  is the current one again, but slots saved
+	// for it  may have been  overwritten by the undone one, so start
+	// over, saving a slot twice doesn't hurt
+	tilemap.Epoch++
+	tilemap.Stats.Backtracked++
+
+	return decision
+}
+
+// Try  to collapse all slots, one  decision per round. On contradiction
+// undo the last decision and ban the tile chosen there. If that leads
+// to a contradiction as well, unwind further. Gives up after retries
+// backtracking steps or if there's no decision left to undo.
+func (tilemap *Tilemap) CollapseBacktrack(ctx context.Context, retries int) error {
+	tilemap.Decisions = nil
+	tilemap.Trail = nil
+	tilemap.History = nil
+	tilemap.Prioritize()
+
+	backtracks := 0
+
+	for !tilemap.Collapsed() {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("collapse cancelled: %w", err)
+		}
+
+		start := time.Now()
+
+		// the heuristic (by default entropy) decides which slot goes
+		// next
+		slot := tilemap.NextSlot()
+		if slot == nil {
+			return errors.New("no collapsible slot left")
+		}
+
+		if DEBUG {
+			fmt.Printf("collapsing slot at point %v\n", slot.Position)
+		}
+
+		tilemap.Decide(slot, slot.Choose(tilemap.Rand))
+
+		err := tilemap.PropagateFrom(slot)
+
+		for err != nil {
+			if DEBUG {
+				fmt.Println(err)
+			}
+
+			if len(tilemap.Decisions) == 0 {
+				// the contradiction error names the broken slot
+				return tilemap.Contradiction(ErrUnsatisfiable)
+			}
+
+			if backtracks >= retries {
+				return tilemap.Contradiction(errors.New("tilemap broken too many times"))
+			}
+
+			decision := tilemap.Undo()
+			backtracks++
+
+			if DEBUG {
+				fmt.Printf("BACKTRACKING: banning tile %d at point %v\n",
+					decision.Tile, decision.Slot.Position)
+			}
+
+			// the chosen tile doesn't work there, the ban belongs to
+			// the parent decision and is undone together with it
+			banned := decision.Slot
+			tilemap.Save(banned, banned.PossibleTiles)
+			banned.PossibleTiles.Unset(decision.Tile)
+			banned.Priority = tilemap.Priority(banned)
+			tilemap.Remember(banned, decision.Tile, true)
+
+			if banned.Broken() {
+				err = fmt.Errorf("slot at position %v has no possible tile left", banned.Position)
+				continue
+			}
+
+			err = tilemap.PropagateFrom(banned)
+		}
+
+		elapsed := time.Since(start)
+		tilemap.Stats.Rounds++
+		tilemap.Stats.RoundsDuration = append(tilemap.Stats.RoundsDuration, elapsed)
+	}
+
+	if !tilemap.Quiet {
+		fmt.Printf("Collapsed: %t, Broken: %t\n", tilemap.Collapsed(), tilemap.Broken())
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// A  compact set of  tile indices, one bit  per tile of  the
+// superposition. Used to store the possible tiles of a slot and the
+// adjacency rules.
+type Bitset []uint64
+
+// Return an empty bitset able to hold size indices
+func NewBitset(size int) Bitset {
+	return make(Bitset, (size+63)/64)
+}
+
+// Return a bitset with all indices from 0 to size-1 set
+func FullBitset(size int) Bitset {
+	bitset := NewBitset(size)
+
+	for i := range bitset {
+		bitset[i] = ^uint64(0)
+	}
+
+	if rest := size % 64; rest != 0 {
+		bitset[len(bitset)-1] = (1 << rest) - 1
+	}
+
+	return bitset
+}
+
+func (bitset Bitset) Set(index int) {
+	bitset[index/64] |= 1 << (index % 64)
+}
+
+func (bitset Bitset) Unset(index int) {
+	bitset[index/64] &^= 1 << (index % 64)
+}
+
+func (bitset Bitset) Has(index int) bool {
+	return bitset[index/64]&(1<<(index%64)) != 0
+}
+
+// Remove all indices
+func (bitset Bitset) Reset() {
+	clear(bitset)
+}
+
+// Number of indices in the set (popcount)
+func (bitset Bitset) Count() int {
+	count := 0
+
+	for _, word := range bitset {
+		count += bits.OnesCount64(word)
+	}
+
+	return count
+}
+
+// Return the  first index >= start  which is in the set,  -1 if there
+// is none. Iterate over a set like this:
+//
+//	for index := bitset.Next(0); index >= 0; index = bitset.Next(index + 1) {}
+func (bitset Bitset) Next(start int) int {
+	word := start / 64
+	if word >= len(bitset) {
+		return -1
+	}
+
+	// ignore the bits below start in the first word
+	current := bitset[word] >> (start % 64) << (start % 64)
+
+	for {
+		if current != 0 {
+			return word*64 + bits.TrailingZeros64(current)
+		}
+
+		word++
+		if word >= len(bitset) {
+			return -1
+		}
+
+		current = bitset[word]
+	}
+}
+
+// Return all indices in the set
+func (bitset Bitset) Indices() []int {
+	indices := []int{}
+
+	for index := bitset.Next(0); index >= 0; index = bitset.Next(index + 1) {
+		indices = append(indices, index)
+	}
+
+	return indices
+}
+
+// Intersect the set with other, in place
+func (bitset Bitset) And(other Bitset) {
+	for i := range bitset {
+		bitset[i] &= other[i]
+	}
+}
+
+// Unite the set with other, in place
+func (bitset Bitset) Or(other Bitset) {
+	for i := range bitset {
+		bitset[i] |= other[i]
+	}
+}
+
+// Overwrite the set with the contents of other, without allocation
+func (bitset Bitset) CopyFrom(other Bitset) {
+	copy(bitset, other)
+}
+
+// Return a copy of the set (snapshot)
+func (bitset Bitset) Copy() Bitset {
+	return append(Bitset{}, bitset...)
+}
+
+func (bitset Bitset) Equal(other Bitset) bool {
+	for i := range bitset {
+		if bitset[i] != other[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (bitset Bitset) String() string {
+	return fmt.Sprint(bitset.Indices())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// What a border constraint refers to
+const (
+	BorderSocket = "socket" // the outward socket (or edge) of the tile
+	BorderTag    = "tag"    // the type or one of the tags of the tile
+	BorderTile   = "tile"   // the LDTK tile id, any variant
+)
+
+var BorderKinds = []string{BorderSocket, BorderTag, BorderTile}
+
+// The side "all" stands for every edge of the map
+const BorderAll = "all"
+
+// Only tiles  matching the constraint may be placed at the given edge
+// of the output map
+type Border struct {
+	Side  Direction
+	Kind  string
+	Value string
+}
+
+// parse a border constraint <side>=<kind>:<value>, e.g. north=tag:wall,
+// the side all results in one constraint per edge
+func ParseBorder(spec string) ([]Border, error) {
+	side, constraint, found := strings.Cut(spec, "=")
+	if !found {
+		return nil, fmt.Errorf("invalid border %q, expected <side>=<kind>:<value>", spec)
+	}
+
+	kind, value, found := strings.Cut(constraint, ":")
+	if !found || value == "" {
+		return nil, fmt.Errorf("invalid border %q, expected <side>=<kind>:<value>", spec)
+	}
+
+	if !Contains(BorderKinds, kind) {
+		return nil, fmt.Errorf("unknown border kind %q, expected one of %v", kind, BorderKinds)
+	}
+
+	if kind == BorderTile {
+		if _, err := strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid tile id in border %q: %w", spec, err)
+		}
+	}
+
+	borders := []Border{}
+
+	for _, direction := range Directions {
+		if side == BorderAll || side == DirectionNames[direction] {
+			borders = append(borders, Border{Side: direction, Kind: kind, Value: value})
+		}
+	}
+
+	if len(borders) == 0 {
+		return nil, fmt.Errorf("unknown border side %q, expected one of %v or %s",
+			side, DirectionNames, BorderAll)
+	}
+
+	return borders, nil
+}
+
+func (border Border) String() string {
+	return fmt.Sprintf("%s=%s:%s", DirectionNames[border.Side], border.Kind, border.Value)
+}
+
+// Return true if the tile may be placed at the border
+func (border Border) Matches(tile *Tile) bool {
+	switch border.Kind {
+	case BorderSocket:
+		return tile.Constraints[border.Side] == border.Value
+	case BorderTag:
+		return tile.Type == border.Value || Contains(tile.Tags, border.Value)
+	case BorderTile:
+		return strconv.Itoa(tile.TileId) == border.Value
+	}
+
+	return false
+}
+
+// Remove all tiles  not matching  the border constraints from the
+// slots at the edges of the output map and propagate the result.
+// Several constraints on the same side must all be met.
+func (wave *Wave) SetBorders(borders []Border) error {
+	if len(borders) == 0 {
+		return nil
+	}
+
+	tilemap := &wave.OutputTilemap
+
+	for _, border := range borders {
+		if Wraps(wave.Periodic, border.Side) {
+			return fmt.Errorf("border %s: the map wraps around on that side", border)
+		}
+
+		allowed := NewBitset(len(wave.Superposition))
+		for _, tile := range wave.Superposition {
+			if border.Matches(tile) {
+				allowed.Set(tile.Index)
+			}
+		}
+
+		if allowed.Count() == 0 {
+			return fmt.Errorf("border %s: no tile matches", border)
+		}
+
+		for _, slot := range tilemap.Slotlist {
+			point := slot.Position.MoveDirection(border.Side)
+
+			if !Exists(tilemap.Slots, point) {
+				slot.PossibleTiles.And(allowed)
+
+				if slot.Broken() {
+					return fmt.Errorf("%w: border %s leaves no tile for slot %d,%d",
+						ErrUnsatisfiable, border, slot.Position.X, slot.Position.Y)
+				}
+			}
+		}
+	}
+
+	if err := tilemap.Propagate(); err != nil {
+		return fmt.Errorf("%w: border constraints contradict each other or the seed level: %s",
+			ErrUnsatisfiable, err)
+	}
+
+	return nil
+}
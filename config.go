@@ -21,6 +21,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/knadh/koanf/providers/confmap"
 	"github.com/knadh/koanf/providers/posflag"
@@ -37,32 +40,130 @@ const (
 	VERSION string = "0.0.1"
 	Usage   string = `This is wfcldtk, a WFC level generator for LDTK.
 
-Usage: gfn [-vd] -p <project> -l <level> [-W <width> -H <height>] [<output image>]
+Usage: gfn [-vd] -p <project> -l <level> [-W <width> -H <height>] [-o <level>] [<output image>]
+       gfn analyze -p <project> -l <level> [options]
+       gfn diagnose -p <project> -l <level> [--format json] [--preview <dir>]
+       gfn regenerate -p <project> -l <level> --seed-level <level>
+           (--region <x,y,w,h> | --mask <mask>) [-o <level>]
+
+Commands:
+analyze                 Try edge settings on the example level and
+                        recommend the best one
+diagnose                Report dead tiles, orphan sockets and corners
+                        no tile fits into
+regenerate              Generate the region of the seed level anew and
+                        keep the rest, write the result back into the
+                        seed level or into a copy (-o)
 
 Options:
 -p --project <project>  Read data from LDTK file <project>
--l --level <level>      Use level <level> as example for overlap mode
+-l --level <level>      Use level <level> as example
 -W --width <width>      Width in number of tiles (not pixel!)
 -H --height <height>    Height
+-o --outlevel <level>   Add generated level <level> to the LDTK project
+   --seed-level <level> Pre-populate the output with tiles of <level>
+   --model <name>       Learn tiles (simple) or NxN patterns (overlap)
+   --rules <source>     Simple model: adjacency from tile edges, the
+                        example's neighbors (sample) or both
+   --rule-file <file>   Simple model: sockets and allowed pairs (YAML/JSON)
+   --variants <mode>    Simple model: add rotated/reflected tiles, none,
+                        tagged (by symmetry class, default) or auto
+   --edges <strategy>   Simple model: compare edge pixels at some points,
+                        averaged segments or the full edge
+   --tolerance <t>      Simple model: max color distance of matching edges
+   --color-distance <d> Measure color distance in rgb or lab (delta E)
+   --alpha <mode>       Alpha channel on edges: exact, ignore or binary
+-c --checkpoints <n>    Number of samples per edge (default 5)
+   --autotune           Analyze first and use the best edge settings
+   --format <format>    Diagnose: print the report as text or json
+   --preview <dir>      Diagnose: write a PNG of each problem into <dir>
+   --pattern-size <n>   Overlap model: size of the patterns (default 2)
+   --symmetry <n>       Overlap model: add rotated/reflected patterns, 1-8
+   --weight <id>=<w>    Set the weight of LDTK tile <id> to <w>, repeatable
+   --heuristic <name>   Slot selection: entropy, scanline, spiral or random
+   --seed <seed>        Random seed, same seed leads to the same output
+   --periodic <axes>    Wrap around on x, y or xy for seamless maps
+   --mask <mask>        Only generate inside the mask: a PNG (black is
+                        unused) or an LDTK IntGrid layer <level>[/<layer>],
+                        regenerate: the cells to generate anew
+   --region <x,y,w,h>   Regenerate: the cells to generate anew
+   --world <c>x<r>      Generate a world of <c> x <r> connected levels of
+                        <width> x <height>, named <outlevel>_<c>_<r>
+   --border <s>=<k>:<v> Restrict side <s> (north..west, all) of the map
+                        to tiles with the outward socket, the tag or
+                        the tile id <v> (<k>: socket, tag, tile)
+   --strategy <name>    On contradictions: backtrack or restart
+   --solver <name>      Randomized wfc or exhaustive csp search, which
+                        proves if there's no solution (small maps only)
+   --solutions <n>      Csp: count up to <n> solutions (0 = all), each
+                        one is written to <output image>-<i>.png
+   --retries <n>        Give up an attempt after <n> backtracks/restarts
+   --restarts <n>       Start over <n> times if an attempt fails
+   --restart-mode <m>   How to start over: fixed, reseed or backoff
+   --timeout <dur>      Give up after <dur>, e.g. 30s or 5m
 
 -d --debug    Show debugging output
 -v --version  Show program version
 
 `
-	DefaultWidth       int = 4
-	DefaultHeight      int = 4
-	DefaultCheckpoints int = 5
+	DefaultWidth       int    = 4
+	DefaultHeight      int    = 4
+	DefaultCheckpoints int    = 5
+	DefaultRetries     int    = 100
+	DefaultPatternSize int    = 2
+	CommandAnalyze     string = "analyze"
+	CommandDiagnose    string = "diagnose"
+	CommandRegenerate  string = "regenerate"
 )
 
+// known commands, given as first argument
+var Commands = []string{CommandAnalyze, CommandDiagnose, CommandRegenerate}
+
 type Config struct {
-	Showversion bool   `koanf:"version"` // -v
-	Debug       bool   `koanf:"debug"`   // -d
-	Project     string `koanf:"project"`
-	Level       string `koanf:"level"`
-	Height      int    `koanf:"height"`
-	Width       int    `koanf:"width"`
-	Outputimage string // arg 1 just used for debugging currently
-	Checkpoints int    `koanf:"checkpoints"`
+	Showversion bool            `koanf:"version"` // -v
+	Debug       bool            `koanf:"debug"`   // -d
+	Project     string          `koanf:"project"`
+	Level       string          `koanf:"level"`
+	Height      int             `koanf:"height"`
+	Width       int             `koanf:"width"`
+	Outputimage string          // arg 1 just used for debugging currently
+	Command     string          // optional first arg, see Commands
+	Autotune    bool            `koanf:"autotune"`
+	Format      string          `koanf:"format"`
+	Preview     string          `koanf:"preview"`
+	Outputlevel string          `koanf:"outlevel"`
+	Seedlevel   string          `koanf:"seed-level"`
+	Weights     []string        `koanf:"weight"`
+	TileWeights map[int]float64 // parsed from Weights
+	Heuristic   string          `koanf:"heuristic"`
+	Seed        int64           `koanf:"seed"`
+	SeedGiven   bool            `koanf:"-"` // 0 is a valid seed as well
+	Strategy    string          `koanf:"strategy"`
+	Solver      string          `koanf:"solver"`
+	Periodic    string          `koanf:"periodic"`
+	Mask        string          `koanf:"mask"`
+	Region      string          `koanf:"region"`
+	WorldSize   string          `koanf:"world"`
+	World       World           `koanf:"-"` // parsed from WorldSize
+	Border      []string        `koanf:"border"`
+	Borders     []Border        `koanf:"-"`         // parsed from Border
+	Solutions   int             `koanf:"solutions"` // -1: just solve
+	Retries     int             `koanf:"retries"`
+	Restarts    int             `koanf:"restarts"`
+	RestartMode string          `koanf:"restart-mode"`
+	Timeout     time.Duration   `koanf:"timeout"`
+	ModelName   string          `koanf:"model"`
+	PatternSize int             `koanf:"pattern-size"`
+	Rules       string          `koanf:"rules"`
+	RuleFile    string          `koanf:"rule-file"`
+	Variants    string          `koanf:"variants"`
+	Edges       string          `koanf:"edges"`
+	Tolerance   float64         `koanf:"tolerance"`
+	Distance    string          `koanf:"color-distance"`
+	Alpha       string          `koanf:"alpha"`
+	Symmetry    int             `koanf:"symmetry"`
+	Model       Model           `koanf:"-"` // assembled from the above
+	Checkpoints int             `koanf:"checkpoints"`
 }
 
 func InitConfig(output io.Writer) (*Config, error) {
@@ -70,9 +171,25 @@ func InitConfig(output io.Writer) (*Config, error) {
 
 	// Load default values using the confmap provider.
 	if err := kloader.Load(confmap.Provider(map[string]interface{}{
-		"width":       DefaultWidth,
-		"height":      DefaultHeight,
-		"checkpoints": DefaultCheckpoints,
+		"width":          DefaultWidth,
+		"height":         DefaultHeight,
+		"checkpoints":    DefaultCheckpoints,
+		"heuristic":      HeuristicEntropy,
+		"strategy":       StrategyBacktrack,
+		"solver":         SolverWFC,
+		"periodic":       PeriodicNone,
+		"solutions":      -1,
+		"retries":        DefaultRetries,
+		"restart-mode":   RestartFixed,
+		"model":          ModelSimple,
+		"pattern-size":   DefaultPatternSize,
+		"rules":          RulesEdges,
+		"variants":       VariantsTagged,
+		"edges":          EdgesPoints,
+		"color-distance": DistanceRGB,
+		"alpha":          AlphaExact,
+		"symmetry":       1,
+		"format":         FormatText,
 	}, "."), nil); err != nil {
 		return nil, fmt.Errorf("failed to load default values into koanf: %w", err)
 	}
@@ -80,7 +197,7 @@ func InitConfig(output io.Writer) (*Config, error) {
 	// setup custom usage
 	flagset := flag.NewFlagSet("config", flag.ContinueOnError)
 	flagset.Usage = func() {
-		fmt.Fprintln(output, Usage)
+		fmt.Fprint(output, Usage)
 		os.Exit(0)
 	}
 
@@ -91,6 +208,37 @@ func InitConfig(output io.Writer) (*Config, error) {
 	flagset.IntP("height", "H", 0, "output height")
 	flagset.StringP("project", "p", "", "LDTK project file")
 	flagset.StringP("level", "l", "", "LDTK level")
+	flagset.StringP("outlevel", "o", "", "LDTK level to create")
+	flagset.String("seed-level", "", "LDTK level to pre-populate from")
+	flagset.String("model", ModelSimple, "model to learn from the example level")
+	flagset.String("rules", RulesEdges, "simple model adjacency rules")
+	flagset.String("rule-file", "", "hand made adjacency rules")
+	flagset.String("variants", VariantsTagged, "tile variants to add")
+	flagset.String("edges", EdgesPoints, "edge sampling strategy")
+	flagset.Float64("tolerance", 0, "edge color tolerance")
+	flagset.String("color-distance", DistanceRGB, "color distance")
+	flagset.String("alpha", AlphaExact, "alpha handling")
+	flagset.IntP("checkpoints", "c", DefaultCheckpoints, "samples per edge")
+	flagset.Bool("autotune", false, "use the best edge settings")
+	flagset.String("format", FormatText, "diagnose report format")
+	flagset.String("preview", "", "diagnose preview directory")
+	flagset.Int("pattern-size", DefaultPatternSize, "overlap model pattern size")
+	flagset.Int("symmetry", 1, "overlap model pattern variants")
+	flagset.StringArray("weight", []string{}, "tile weight override")
+	flagset.String("heuristic", HeuristicEntropy, "slot selection heuristic")
+	flagset.Int64("seed", 0, "random seed")
+	flagset.String("strategy", StrategyBacktrack, "contradiction strategy")
+	flagset.String("solver", SolverWFC, "solver backend")
+	flagset.String("periodic", PeriodicNone, "wrapping axes")
+	flagset.String("mask", "", "generation mask")
+	flagset.String("region", "", "region to regenerate")
+	flagset.String("world", "", "world size in levels")
+	flagset.StringArray("border", []string{}, "border constraint")
+	flagset.Int("solutions", -1, "number of solutions to count")
+	flagset.Int("retries", DefaultRetries, "budget per attempt")
+	flagset.Int("restarts", 0, "number of restarts")
+	flagset.String("restart-mode", RestartFixed, "restart mode")
+	flagset.Duration("timeout", 0, "wall-clock budget")
 
 	if err := flagset.Parse(os.Args[1:]); err != nil {
 		return nil, fmt.Errorf("failed to parse program arguments: %w", err)
@@ -107,10 +255,144 @@ func InitConfig(output io.Writer) (*Config, error) {
 		return nil, fmt.Errorf("error unmarshalling: %w", err)
 	}
 
+	conf.SeedGiven = flagset.Changed("seed")
+
+	if err := CheckHeuristic(conf.Heuristic); err != nil {
+		return nil, err
+	}
+
+	if err := CheckStrategy(conf.Strategy); err != nil {
+		return nil, err
+	}
+
+	if err := CheckRestartMode(conf.RestartMode); err != nil {
+		return nil, err
+	}
+
+	if err := CheckFormat(conf.Format); err != nil {
+		return nil, err
+	}
+
+	if err := CheckSolver(conf.Solver); err != nil {
+		return nil, err
+	}
+
+	if err := CheckPeriodic(conf.Periodic); err != nil {
+		return nil, err
+	}
+
+	if conf.Solutions >= 0 && conf.Solver != SolverCSP {
+		return nil, fmt.Errorf("counting solutions requires --solver %s", SolverCSP)
+	}
+
+	conf.Model = Model{
+		Name:      conf.ModelName,
+		Rules:     conf.Rules,
+		RuleFile:  conf.RuleFile,
+		Variants:  conf.Variants,
+		FlipsOnly: conf.Outputlevel != "", // LDTK can't rotate tiles
+		Edges: EdgeMatcher{
+			Strategy:    conf.Edges,
+			Checkpoints: conf.Checkpoints,
+			Tolerance:   conf.Tolerance,
+			Distance:    conf.Distance,
+			Alpha:       conf.Alpha,
+		},
+		PatternSize: conf.PatternSize,
+		Symmetry:    conf.Symmetry,
+	}
+
+	if err := CheckModel(conf.Model); err != nil {
+		return nil, err
+	}
+
+	if err := CheckEdgeMatcher(conf.Model.Edges); err != nil {
+		return nil, err
+	}
+
+	// tile weight overrides
+	conf.TileWeights = map[int]float64{}
+	for _, spec := range conf.Weights {
+		tileid, weight, err := ParseWeight(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.TileWeights[tileid] = weight
+	}
+
+	// border constraints
+	for _, spec := range conf.Border {
+		borders, err := ParseBorder(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.Borders = append(conf.Borders, borders...)
+	}
+
+	// world size, a single level by default
+	conf.World = World{Columns: 1, Rows: 1}
+	if conf.WorldSize != "" {
+		if conf.Outputlevel == "" {
+			return nil, fmt.Errorf("a world requires a level name prefix (-o)")
+		}
+
+		world, err := ParseWorld(conf.WorldSize)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.World = world
+	}
+
 	// arg is the output file
-	if len(flagset.Args()) > 0 {
-		conf.Outputimage = flagset.Args()[0]
+	args := flagset.Args()
+	if len(args) > 0 && Contains(Commands, args[0]) {
+		conf.Command = args[0]
+		args = args[1:]
+	}
+
+	if len(args) > 0 {
+		conf.Outputimage = args[0]
+	}
+
+	if conf.Command == CommandRegenerate {
+		if conf.Seedlevel == "" {
+			return nil, fmt.Errorf("regenerate requires the level to edit (--seed-level)")
+		}
+
+		if (conf.Region == "") == (conf.Mask == "") {
+			return nil, fmt.Errorf("regenerate requires either --region or --mask")
+		}
+
+		if conf.WorldSize != "" {
+			return nil, fmt.Errorf("regenerate works on a single level, --world is not supported")
+		}
+
+		// the result is always written into the LDTK project
+		conf.Model.FlipsOnly = true
 	}
 
 	return conf, nil
 }
+
+// parse a weight override <id>=<weight>
+func ParseWeight(spec string) (int, float64, error) {
+	id, value, found := strings.Cut(spec, "=")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid weight %q, expected <tile id>=<weight>", spec)
+	}
+
+	tileid, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid tile id in weight %q: %w", spec, err)
+	}
+
+	weight, err := strconv.ParseFloat(value, 64)
+	if err != nil || weight < 0 {
+		return 0, 0, fmt.Errorf("invalid weight %q, must be a positive number", spec)
+	}
+
+	return tileid, weight, nil
+}
@@ -5,14 +5,87 @@ import (
 	"encoding/binary"
 	"fmt"
 	"image"
+	"math"
 )
 
 type Color [4]uint8
 
+// Strategies to sample the pixels along a tile edge
+const (
+	EdgesPoints   = "points"   // some evenly spaced pixels
+	EdgesSegments = "segments" // the average color of each segment
+	EdgesFull     = "full"     // every pixel of the edge
+)
+
+var EdgeStrategies = []string{EdgesPoints, EdgesSegments, EdgesFull}
+
+// How to compare colors if a tolerance is given
+const (
+	DistanceRGB = "rgb" // euclidean distance of the RGBA values, 0-255
+	DistanceLab = "lab" // delta E (CIE76) in Lab space, alpha in percent
+)
+
+var Distances = []string{DistanceRGB, DistanceLab}
+
+// How to handle the alpha channel
+const (
+	AlphaExact  = "exact"  // compare it like any other channel
+	AlphaIgnore = "ignore" // only compare the colors
+	AlphaBinary = "binary" // pixels are either transparent or opaque
+)
+
+var AlphaModes = []string{AlphaExact, AlphaIgnore, AlphaBinary}
+
+// Describes how the edges of the tiles are being compared. With a
+// tolerance of 0 the sampled colors have to be exactly equal, otherwise
+// edges are grouped into classes of similar edges.
+type EdgeMatcher struct {
+	Strategy    string
+	Checkpoints int     // points, segments: number of samples per edge
+	Tolerance   float64 // maximum color distance of two matching samples
+	Distance    string
+	Alpha       string
+}
+
+// Return the default edge matcher: exact colors of some pixels
+func NewEdgeMatcher(checkpoints int) EdgeMatcher {
+	return EdgeMatcher{
+		Strategy:    EdgesPoints,
+		Checkpoints: checkpoints,
+		Distance:    DistanceRGB,
+		Alpha:       AlphaExact,
+	}
+}
+
+// check if the edge matcher is usable
+func CheckEdgeMatcher(matcher EdgeMatcher) error {
+	if !Contains(EdgeStrategies, matcher.Strategy) {
+		return fmt.Errorf("unknown edge strategy %q, expected one of %v", matcher.Strategy, EdgeStrategies)
+	}
+
+	if !Contains(Distances, matcher.Distance) {
+		return fmt.Errorf("unknown color distance %q, expected one of %v", matcher.Distance, Distances)
+	}
+
+	if !Contains(AlphaModes, matcher.Alpha) {
+		return fmt.Errorf("unknown alpha mode %q, expected one of %v", matcher.Alpha, AlphaModes)
+	}
+
+	if matcher.Checkpoints < 1 {
+		return fmt.Errorf("checkpoints must be at least 1, got %d", matcher.Checkpoints)
+	}
+
+	if matcher.Tolerance < 0 {
+		return fmt.Errorf("tolerance must not be negative, got %g", matcher.Tolerance)
+	}
+
+	return nil
+}
+
 // get color value from 1 pixel position
 func GetColor(img image.Image, x, y int) Color {
 	r, g, b, a := img.At(x, y).RGBA()
-	return Color{uint8(r), uint8(g), uint8(b), uint8(a)}
+	return Color{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
 }
 
 // turn color value into hex string
@@ -20,41 +93,198 @@ func HexFromColor(c Color) string {
 	return fmt.Sprintf("%02x%02x%02x%02x", c[0], c[1], c[2], c[3])
 }
 
-// returns the adjacency constraint id for the given tile image
-// in the provided direction.
-func GetConstraint(tileimage image.Image, direction Direction, count int) string {
-	width := tileimage.Bounds().Max.X
-	height := tileimage.Bounds().Max.Y
+// Apply the alpha mode to the given color
+func (matcher *EdgeMatcher) Normalize(color Color) Color {
+	switch matcher.Alpha {
+	case AlphaIgnore:
+		color[3] = 255
+	case AlphaBinary:
+		if color[3] < 128 {
+			return Color{}
+		}
 
-	wdist := width / count
-	hdist := height / count
+		color[3] = 255
+	}
 
-	var hash string
-	points := make([]Color, count)
+	return color
+}
+
+// Sample the pixels along the edge  of the tile in the given direction,
+// north and south from left to right, east and west from top to bottom
+func (matcher *EdgeMatcher) Profile(tileimage image.Image, direction Direction) []Color {
+	bounds := tileimage.Bounds()
+
+	length := bounds.Dx()
+	if direction == East || direction == West {
+		length = bounds.Dy()
+	}
+
+	// pixel number i of the edge
+	pixel := func(i int) Color {
+		var color Color
 
-	for i := 0; i < count; i++ {
 		switch direction {
 		case North:
-			points[i] = GetColor(tileimage, wdist+i*wdist, 0)
+			color = GetColor(tileimage, bounds.Min.X+i, bounds.Min.Y)
 		case South:
-			points[i] = GetColor(tileimage, wdist+i*wdist, height-1)
+			color = GetColor(tileimage, bounds.Min.X+i, bounds.Max.Y-1)
 		case West:
-			points[i] = GetColor(tileimage, 0, hdist+i*hdist)
+			color = GetColor(tileimage, bounds.Min.X, bounds.Min.Y+i)
 		case East:
-			points[i] = GetColor(tileimage, width-1, hdist+i*hdist)
+			color = GetColor(tileimage, bounds.Max.X-1, bounds.Min.Y+i)
 		}
+
+		return matcher.Normalize(color)
 	}
 
-	// Generate a hash from the colors
-	hash = ""
-	for _, c := range points {
+	count := min(matcher.Checkpoints, length)
+	if matcher.Strategy == EdgesFull {
+		count = length
+	}
+
+	profile := make([]Color, count)
+
+	for i := 0; i < count; i++ {
+		start := i * length / count
+		end := (i + 1) * length / count
+
+		switch matcher.Strategy {
+		case EdgesSegments:
+			sum := [4]int{}
+			for p := start; p < end; p++ {
+				color := pixel(p)
+				for c := range sum {
+					sum[c] += int(color[c])
+				}
+			}
+
+			for c := range sum {
+				profile[i][c] = uint8((sum[c] + (end-start)/2) / (end - start))
+			}
+		case EdgesFull:
+			profile[i] = pixel(i)
+		default:
+			// evenly spaced, leaving out the corners, which usually
+			// belong to the adjacent edges
+			profile[i] = pixel((i + 1) * length / (count + 1))
+		}
+	}
+
+	return profile
+}
+
+// returns the adjacency constraint id for the given tile image in the
+// provided direction, a hash of the sampled colors
+func (matcher *EdgeMatcher) Constraint(tileimage image.Image, direction Direction) string {
+	hash := ""
+	for _, c := range matcher.Profile(tileimage, direction) {
 		hash += HexFromColor(c)
 	}
 
 	sum := sha256.Sum256([]byte(hash))
-	res := fmt.Sprintf("%x", sum)[:8]
 
-	return res
+	return fmt.Sprintf("%x", sum)[:8]
+}
+
+// Distance of two colors according to the configured distance
+func (matcher *EdgeMatcher) ColorDistance(a, b Color) float64 {
+	if matcher.Distance == DistanceLab {
+		la, aa, ba := RGBToLab(a)
+		lb, ab, bb := RGBToLab(b)
+		alpha := (float64(a[3]) - float64(b[3])) / 255 * 100
+
+		return math.Sqrt((la-lb)*(la-lb) + (aa-ab)*(aa-ab) + (ba-bb)*(ba-bb) + alpha*alpha)
+	}
+
+	sum := 0.0
+	for c := range a {
+		diff := float64(a[c]) - float64(b[c])
+		sum += diff * diff
+	}
+
+	return math.Sqrt(sum)
+}
+
+// Two edges match, if all their samples are within the tolerance
+func (matcher *EdgeMatcher) Matches(a, b []Color) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if matcher.ColorDistance(a[i], b[i]) > matcher.Tolerance {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Replace the constraints of  the tiles by edge classes, if a tolerance
+// is configured. Each edge joins the first class whose first edge it
+// matches, so the result depends on the order of the tiles only. Tiles
+// with sockets are left alone.
+func (matcher *EdgeMatcher) Classify(superposition Superposition) {
+	if matcher.Tolerance == 0 {
+		return
+	}
+
+	classes := [][]Color{}
+
+	for _, tile := range superposition {
+		if tile.Sockets {
+			continue
+		}
+
+		for _, direction := range Directions {
+			profile := matcher.Profile(tile.Image, direction)
+			class := -1
+
+			for index, representative := range classes {
+				if matcher.Matches(profile, representative) {
+					class = index
+					break
+				}
+			}
+
+			if class < 0 {
+				class = len(classes)
+				classes = append(classes, profile)
+			}
+
+			tile.Constraints[direction] = fmt.Sprintf("edge%d", class)
+		}
+	}
+}
+
+// Convert a color from sRGB to CIE Lab (D65)
+func RGBToLab(color Color) (float64, float64, float64) {
+	linear := func(c uint8) float64 {
+		v := float64(c) / 255
+		if v <= 0.04045 {
+			return v / 12.92
+		}
+
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+
+	r, g, b := linear(color[0]), linear(color[1]), linear(color[2])
+
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*b
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+
+		return (24389.0/27*t + 16) / 116
+	}
+
+	fx, fy, fz := f(x), f(y), f(z)
+
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
 }
 
 // convert a color value to a byte array
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"slices"
+	"strings"
+)
+
+// Number of steps kept in Tilemap.History
+const HistoryLength = 8
+
+// Maximum number of remaining tiles and sockets listed per neighbor
+const ContradictionTiles = 8
+
+// One step of the solver as remembered for contradiction reports
+type Step struct {
+	Position Point
+	Tile     *Tile
+	Banned   bool // the tile has been banned after backtracking, not chosen
+}
+
+func (step Step) String() string {
+	action := "collapsed to"
+	if step.Banned {
+		action = "banned"
+	}
+
+	return fmt.Sprintf("slot %d,%d %s %s", step.Position.X, step.Position.Y, action, NewTileRef(step.Tile))
+}
+
+// A neighbor of the broken slot at the time of the contradiction
+type ContradictionNeighbor struct {
+	Direction Direction
+	Position  Point
+	Tiles     Superposition // the tiles it still allows
+	Sockets   []string      // their sockets facing the broken slot, simple model only
+}
+
+// Returned if collapsing gave up. Describes the slot which ran out of
+// tiles last, its neighbors and the steps which led there.
+type ContradictionError struct {
+	Position  Point
+	Neighbors []ContradictionNeighbor // only existing neighbors
+	History   []Step                  // the last steps, oldest first
+	Err       error                   // why the solver gave up
+}
+
+func (cerr *ContradictionError) Error() string {
+	return fmt.Sprintf("%s: slot at position %d,%d has no possible tile left",
+		cerr.Err, cerr.Position.X, cerr.Position.Y)
+}
+
+func (cerr *ContradictionError) Unwrap() error {
+	return cerr.Err
+}
+
+// Return a human readable explanation of the contradiction
+func (cerr *ContradictionError) Explain() string {
+	var explanation strings.Builder
+
+	fmt.Fprintf(&explanation, "Contradiction at slot %d,%d, no tile fits all of its neighbors:\n",
+		cerr.Position.X, cerr.Position.Y)
+
+	for _, neighbor := range cerr.Neighbors {
+		fmt.Fprintf(&explanation, "  %-5s neighbor %d,%d: %d tile(s)",
+			DirectionNames[neighbor.Direction], neighbor.Position.X, neighbor.Position.Y,
+			len(neighbor.Tiles))
+
+		if neighbor.Sockets != nil {
+			sockets := strings.Join(neighbor.Sockets, ", ")
+			if len(neighbor.Sockets) > ContradictionTiles {
+				sockets = fmt.Sprintf("%s, ... %d more",
+					strings.Join(neighbor.Sockets[:ContradictionTiles], ", "),
+					len(neighbor.Sockets)-ContradictionTiles)
+			}
+
+			fmt.Fprintf(&explanation, ", sockets facing the slot: %s", sockets)
+		}
+
+		fmt.Fprintln(&explanation)
+
+		for i, tile := range neighbor.Tiles {
+			if i == ContradictionTiles {
+				fmt.Fprintf(&explanation, "    ... %d more\n", len(neighbor.Tiles)-i)
+				break
+			}
+
+			fmt.Fprintf(&explanation, "    %s\n", NewTileRef(tile))
+		}
+	}
+
+	if len(cerr.History) > 0 {
+		fmt.Fprintln(&explanation, "Last steps:")
+
+		for _, step := range cerr.History {
+			fmt.Fprintf(&explanation, "  %s\n", step)
+		}
+	}
+
+	return explanation.String()
+}
+
+// Remember a step of the solver, only the last HistoryLength are kept
+func (tilemap *Tilemap) Remember(slot *Slot, tile int, banned bool) {
+	tilemap.History = append(tilemap.History, Step{
+		Position: slot.Position,
+		Tile:     slot.Superposition[tile],
+		Banned:   banned,
+	})
+
+	if len(tilemap.History) > HistoryLength {
+		tilemap.History = tilemap.History[len(tilemap.History)-HistoryLength:]
+	}
+}
+
+// Build a  contradiction error from  the current  state of the tilemap,
+// which has to contain a broken slot. Otherwise cause is returned as is.
+func (tilemap *Tilemap) Contradiction(cause error) error {
+	var broken *Slot
+
+	for _, slot := range tilemap.Slotlist {
+		if slot.Broken() {
+			broken = slot
+			break
+		}
+	}
+
+	if broken == nil {
+		return cause
+	}
+
+	cerr := &ContradictionError{
+		Position: broken.Position,
+		History:  slices.Clone(tilemap.History),
+		Err:      cause,
+	}
+
+	neighbors, err := tilemap.GetSlotNeighbors(broken)
+	if err != nil {
+		return errors.Join(cause, err)
+	}
+
+	for direction, slot := range neighbors {
+		if slot == nil {
+			continue
+		}
+
+		neighbor := ContradictionNeighbor{
+			Direction: Direction(direction),
+			Position:  slot.Position,
+			Tiles:     slot.Possible(),
+			Sockets:   []string{},
+		}
+
+		for _, tile := range neighbor.Tiles {
+			socket := tile.Constraints[GetAdverseDir(Direction(direction))]
+			if !Contains(neighbor.Sockets, socket) {
+				neighbor.Sockets = append(neighbor.Sockets, socket)
+			}
+		}
+
+		cerr.Neighbors = append(cerr.Neighbors, neighbor)
+	}
+
+	return cerr
+}
+
+// Colors of the contradiction overlay
+var (
+	contradictionBroken    = color.RGBA{255, 0, 0, 255}
+	contradictionNeighbor  = color.RGBA{255, 160, 0, 255}
+	contradictionStep      = color.RGBA{255, 255, 0, 255}
+	contradictionUndecided = color.RGBA{0, 0, 0, 160}
+)
+
+// Highlight  the  failing area  on the  rendered map: the broken slot
+// in red, its neighbors framed orange, the slots of the last steps
+// framed yellow. Undecided slots are darkened.
+func (cerr *ContradictionError) Highlight(img draw.Image, cellsize int, tilemap *Tilemap) {
+	cell := func(point Point) image.Rectangle {
+		return image.Rect(point.X*cellsize, point.Y*cellsize,
+			(point.X+1)*cellsize, (point.Y+1)*cellsize)
+	}
+
+	frame := func(rect image.Rectangle, col color.Color) {
+		width := max(1, cellsize/10)
+		uniform := &image.Uniform{col}
+
+		for _, border := range []image.Rectangle{
+			image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+width),
+			image.Rect(rect.Min.X, rect.Max.Y-width, rect.Max.X, rect.Max.Y),
+			image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+width, rect.Max.Y),
+			image.Rect(rect.Max.X-width, rect.Min.Y, rect.Max.X, rect.Max.Y),
+		} {
+			draw.Draw(img, border, uniform, image.Point{}, draw.Src)
+		}
+	}
+
+	for _, slot := range tilemap.Slotlist {
+		if slot.Count() > 1 {
+			draw.Draw(img, cell(slot.Position), &image.Uniform{contradictionUndecided},
+				image.Point{}, draw.Over)
+		}
+	}
+
+	for _, step := range cerr.History {
+		frame(cell(step.Position), contradictionStep)
+	}
+
+	for _, neighbor := range cerr.Neighbors {
+		frame(cell(neighbor.Position), contradictionNeighbor)
+	}
+
+	draw.Draw(img, cell(cerr.Position), &image.Uniform{contradictionBroken}, image.Point{}, draw.Src)
+}
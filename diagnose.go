@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Output formats of the diagnosis
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var Formats = []string{FormatText, FormatJSON}
+
+// A tile of the superposition as shown in the report
+type TileRef struct {
+	Index    int    `json:"index"`
+	TileId   int    `json:"tileid"`
+	Src      [2]int `json:"src"`
+	Rotation int    `json:"rotation,omitempty"`
+	Flip     bool   `json:"flip,omitempty"`
+}
+
+// A tile which has no compatible neighbor in the given directions, it
+// can only ever be placed at the border of the map
+type DeadTile struct {
+	Tile       TileRef  `json:"tile"`
+	Directions []string `json:"directions"`
+	Preview    string   `json:"preview,omitempty"`
+}
+
+// A socket (or edge class)  which appears on one side of some tiles, but
+// never on the adverse side of any tile, so it never matches
+type OrphanSocket struct {
+	Socket    string       `json:"socket"`
+	Direction string       `json:"direction"`
+	Tiles     []OrphanTile `json:"tiles"`
+}
+
+// A tile having an orphan socket, the preview marks its side
+type OrphanTile struct {
+	Tile    TileRef `json:"tile"`
+	Preview string  `json:"preview,omitempty"`
+}
+
+/*
+A corner which can't be completed: the tiles Vertical and Horizontal may
+both be placed next to Diagonal, but no tile fits next to both of them,
+e.g. for the north west diagonal:
+
+	Diagonal   Vertical
+	Horizontal    ?
+*/
+type MissingTile struct {
+	Diagonal   TileRef `json:"diagonal"`
+	Vertical   TileRef `json:"vertical"`
+	Horizontal TileRef `json:"horizontal"`
+	Corner     string  `json:"corner"` // where the diagonal tile is, e.g. "north west"
+	Preview    string  `json:"preview,omitempty"`
+}
+
+type Diagnosis struct {
+	Tiles   int            `json:"tiles"`
+	Dead    []DeadTile     `json:"dead"`
+	Orphans []OrphanSocket `json:"orphans"`
+	Missing []MissingTile  `json:"missing"`
+}
+
+func NewTileRef(tile *Tile) TileRef {
+	return TileRef{
+		Index:    tile.Index,
+		TileId:   tile.TileId,
+		Src:      [2]int{tile.Src.X, tile.Src.Y},
+		Rotation: tile.Transform.Rotation * 90,
+		Flip:     tile.Transform.Flip,
+	}
+}
+
+func (ref TileRef) String() string {
+	variant := ""
+	if ref.Rotation != 0 || ref.Flip {
+		variant = fmt.Sprintf(" rotated %d flipped %t", ref.Rotation, ref.Flip)
+	}
+
+	return fmt.Sprintf("#%d (tile %d at %d,%d%s)", ref.Index, ref.TileId, ref.Src[0], ref.Src[1], variant)
+}
+
+// check if the given format is known
+func CheckFormat(format string) error {
+	if !Contains(Formats, format) {
+		return fmt.Errorf("unknown format %q, expected one of %v", format, Formats)
+	}
+
+	return nil
+}
+
+// Examine the superposition and  the adjacency rules of the wave. If
+// previewdir is set, write a preview image of each problem into it.
+func (wave *Wave) Diagnose(previewdir string) (*Diagnosis, error) {
+	diagnosis := &Diagnosis{
+		Tiles:   len(wave.Superposition),
+		Dead:    []DeadTile{},
+		Orphans: []OrphanSocket{},
+		Missing: []MissingTile{},
+	}
+
+	if previewdir != "" {
+		if err := os.MkdirAll(previewdir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create preview directory: %w", err)
+		}
+	}
+
+	for _, tile := range wave.Superposition {
+		dead := DeadTile{Tile: NewTileRef(tile), Directions: []string{}}
+		sides := []Direction{}
+
+		for _, direction := range Directions {
+			if wave.Adjacency.Compatible(tile.Index, direction).Count() == 0 {
+				dead.Directions = append(dead.Directions, DirectionNames[direction])
+				sides = append(sides, direction)
+			}
+		}
+
+		if len(sides) == 0 {
+			continue
+		}
+
+		if previewdir != "" {
+			dead.Preview = filepath.Join(previewdir, fmt.Sprintf("dead-%d.png", tile.Index))
+			if err := SavePNG(dead.Preview, wave.PreviewDead(tile, sides)); err != nil {
+				return nil, err
+			}
+		}
+
+		diagnosis.Dead = append(diagnosis.Dead, dead)
+	}
+
+	// sockets only mean something if the rules are made from them
+	if wave.Model.Name == ModelSimple && wave.Model.Rules == RulesEdges {
+		orphans, err := wave.OrphanSockets(previewdir)
+		if err != nil {
+			return nil, err
+		}
+
+		diagnosis.Orphans = orphans
+	}
+
+	missing, err := wave.MissingTiles(previewdir)
+	if err != nil {
+		return nil, err
+	}
+
+	diagnosis.Missing = missing
+
+	return diagnosis, nil
+}
+
+// Find all sockets which never appear on the adverse side and  leave the
+// tiles without a compatible neighbor on that side. If previewdir
+// is set, write a preview of each tile having one into it.
+func (wave *Wave) OrphanSockets(previewdir string) ([]OrphanSocket, error) {
+	orphans := []OrphanSocket{}
+
+	for _, direction := range Directions {
+		adverse := map[string]bool{}
+		for _, tile := range wave.Superposition {
+			adverse[tile.Constraints[GetAdverseDir(direction)]] = true
+		}
+
+		// keep the order of first appearance
+		sockets := []string{}
+		tiles := map[string][]OrphanTile{}
+
+		for _, tile := range wave.Superposition {
+			socket := tile.Constraints[direction]
+			if adverse[socket] {
+				continue
+			}
+
+			// allowed pairs of the rule file may use it after all
+			if wave.Adjacency.Compatible(tile.Index, direction).Count() > 0 {
+				continue
+			}
+
+			if !Exists(tiles, socket) {
+				sockets = append(sockets, socket)
+			}
+
+			orphan := OrphanTile{Tile: NewTileRef(tile)}
+
+			if previewdir != "" {
+				orphan.Preview = filepath.Join(previewdir,
+					fmt.Sprintf("orphan-%d-%s.png", tile.Index, DirectionNames[direction]))
+
+				err := SavePNG(orphan.Preview, wave.PreviewDead(tile, []Direction{direction}))
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			tiles[socket] = append(tiles[socket], orphan)
+		}
+
+		for _, socket := range sockets {
+			orphans = append(orphans, OrphanSocket{
+				Socket:    socket,
+				Direction: DirectionNames[direction],
+				Tiles:     tiles[socket],
+			})
+		}
+	}
+
+	return orphans, nil
+}
+
+// Find all corners which can't be completed, for each position of the
+// diagonal tile. Each pair of vertical and horizontal tiles is only
+// reported once.
+func (wave *Wave) MissingTiles(previewdir string) ([]MissingTile, error) {
+	missing := []MissingTile{}
+	adjacency := wave.Adjacency
+	candidates := NewBitset(len(wave.Superposition))
+
+	corners := []struct {
+		vertical, horizontal Direction // where the diagonal tile is
+		name                 string
+	}{
+		{North, West, "north west"},
+		{North, East, "north east"},
+		{South, West, "south west"},
+		{South, East, "south east"},
+	}
+
+	for _, corner := range corners {
+		reported := map[[2]int]bool{}
+
+		// the missing tile is south east of a north west diagonal etc
+		down := GetAdverseDir(corner.vertical)
+		right := GetAdverseDir(corner.horizontal)
+
+		for _, diagonal := range wave.Superposition {
+			verticals := adjacency.Compatible(diagonal.Index, right)
+			horizontals := adjacency.Compatible(diagonal.Index, down)
+
+			for vertical := verticals.Next(0); vertical >= 0; vertical = verticals.Next(vertical + 1) {
+				for horizontal := horizontals.Next(0); horizontal >= 0; horizontal = horizontals.Next(horizontal + 1) {
+					if reported[[2]int{vertical, horizontal}] {
+						continue
+					}
+
+					candidates.CopyFrom(adjacency.Compatible(vertical, down))
+					candidates.And(adjacency.Compatible(horizontal, right))
+
+					if candidates.Count() > 0 {
+						continue
+					}
+
+					reported[[2]int{vertical, horizontal}] = true
+
+					problem := MissingTile{
+						Diagonal:   NewTileRef(diagonal),
+						Vertical:   NewTileRef(wave.Superposition[vertical]),
+						Horizontal: NewTileRef(wave.Superposition[horizontal]),
+						Corner:     corner.name,
+					}
+
+					if previewdir != "" {
+						problem.Preview = filepath.Join(previewdir,
+							fmt.Sprintf("missing-%d-%d-%d.png", diagonal.Index, vertical, horizontal))
+
+						err := SavePNG(problem.Preview, wave.PreviewMissing(diagonal,
+							wave.Superposition[vertical], wave.Superposition[horizontal],
+							corner.vertical, corner.horizontal))
+						if err != nil {
+							return nil, err
+						}
+					}
+
+					missing = append(missing, problem)
+				}
+			}
+		}
+	}
+
+	return missing, nil
+}
+
+var previewRed = color.RGBA{255, 0, 0, 255}
+
+// Render the tile with red bars on the given sides, the dead ones or
+// the ones with an orphan socket
+func (wave *Wave) PreviewDead(tile *Tile, sides []Direction) image.Image {
+	size := wave.Cellsize
+	bar := max(1, size/8)
+
+	preview := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(preview, preview.Bounds(), tile.Image, tile.Image.Bounds().Min, draw.Src)
+
+	for _, side := range sides {
+		var rect image.Rectangle
+
+		switch side {
+		case North:
+			rect = image.Rect(0, 0, size, bar)
+		case South:
+			rect = image.Rect(0, size-bar, size, size)
+		case West:
+			rect = image.Rect(0, 0, bar, size)
+		case East:
+			rect = image.Rect(size-bar, 0, size, size)
+		}
+
+		draw.Draw(preview, rect, &image.Uniform{previewRed}, image.Point{}, draw.Src)
+	}
+
+	return preview
+}
+
+// Render the corner: the three tiles and a red square where no tile fits
+func (wave *Wave) PreviewMissing(diagonal, vertical, horizontal *Tile, up, left Direction) image.Image {
+	size := wave.Cellsize
+	preview := image.NewRGBA(image.Rect(0, 0, size*2, size*2))
+
+	// grid position of the diagonal tile, the others follow
+	dx, dy := 0, 0
+	if left == East {
+		dx = 1
+	}
+	if up == South {
+		dy = 1
+	}
+
+	cells := []struct {
+		x, y int
+		tile *Tile
+	}{
+		{dx, dy, diagonal},
+		{1 - dx, dy, vertical},
+		{dx, 1 - dy, horizontal},
+		{1 - dx, 1 - dy, nil},
+	}
+
+	for _, cell := range cells {
+		rect := image.Rect(cell.x*size, cell.y*size, (cell.x+1)*size, (cell.y+1)*size)
+
+		if cell.tile == nil {
+			draw.Draw(preview, rect, &image.Uniform{previewRed}, image.Point{}, draw.Src)
+			continue
+		}
+
+		draw.Draw(preview, rect, cell.tile.Image, cell.tile.Image.Bounds().Min, draw.Src)
+	}
+
+	return preview
+}
+
+// Print the diagnosis in the given format
+func (diagnosis *Diagnosis) Print(output io.Writer, format string) error {
+	if format == FormatJSON {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(diagnosis)
+	}
+
+	fmt.Fprintf(output, "%d tiles examined\n", diagnosis.Tiles)
+
+	fmt.Fprintf(output, "\nTiles without compatible neighbor (%d):\n", len(diagnosis.Dead))
+	for _, dead := range diagnosis.Dead {
+		fmt.Fprintf(output, "  %s: %v %s\n", dead.Tile, dead.Directions, dead.Preview)
+	}
+
+	fmt.Fprintf(output, "\nSockets appearing on one side only (%d):\n", len(diagnosis.Orphans))
+	for _, orphan := range diagnosis.Orphans {
+		fmt.Fprintf(output, "  %s on the %s side of:\n", orphan.Socket, orphan.Direction)
+		for _, tile := range orphan.Tiles {
+			fmt.Fprintf(output, "    %s %s\n", tile.Tile, tile.Preview)
+		}
+	}
+
+	fmt.Fprintf(output, "\nCorners no tile fits into (%d):\n", len(diagnosis.Missing))
+	for _, missing := range diagnosis.Missing {
+		fmt.Fprintf(output, "  %s corner %s, vertical %s, horizontal %s %s\n",
+			missing.Corner, missing.Diagonal, missing.Vertical, missing.Horizontal, missing.Preview)
+	}
+
+	return nil
+}
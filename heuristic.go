@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Heuristics  to  decide  which  slot  to  collapse  next.  Entropy is
+// the classic WFC choice, the others produce different looking maps.
+const (
+	HeuristicEntropy  = "entropy"  // lowest shannon entropy first
+	HeuristicScanline = "scanline" // row by row, from the top left
+	HeuristicSpiral   = "spiral"   // spiral outwards from the center
+	HeuristicRandom   = "random"   // any uncollapsed slot
+)
+
+var Heuristics = []string{HeuristicEntropy, HeuristicScanline, HeuristicSpiral, HeuristicRandom}
+
+// Random noise added to the entropy, so that slots with equal entropy
+// are being picked randomly instead of always the top left one
+const EntropyNoise = 1e-6
+
+// check if the given heuristic is known
+func CheckHeuristic(heuristic string) error {
+	if !Contains(Heuristics, heuristic) {
+		return fmt.Errorf("unknown heuristic %q, expected one of %v", heuristic, Heuristics)
+	}
+
+	return nil
+}
+
+// Calculate  the  shannon  entropy  of the  slot  using  the  tile
+// weights. A  collapsed slot has  an entropy  of 0, the more  (and the
+// more evenly weighted) tiles are possible, the higher it gets.
+func (slot *Slot) Entropy() float64 {
+	total := 0.0
+	logsum := 0.0
+
+	possible := slot.PossibleTiles
+
+	for index := possible.Next(0); index >= 0; index = possible.Next(index + 1) {
+		weight := slot.Superposition[index].Weight
+
+		if weight > 0 {
+			total += weight
+			logsum += weight * math.Log(weight)
+		}
+	}
+
+	if total <= 0 {
+		// only weightless tiles, all equally likely
+		return math.Log(float64(slot.Count()))
+	}
+
+	return math.Log(total) - logsum/total
+}
+
+// Return the priority of the slot according to the heuristic, lower
+// goes first
+func (tilemap *Tilemap) Priority(slot *Slot) float64 {
+	point := slot.Position
+
+	switch tilemap.Heuristic {
+	case HeuristicScanline:
+		return float64(point.Y*tilemap.Width + point.X)
+	case HeuristicSpiral:
+		return tilemap.SpiralRank(point)
+	case HeuristicRandom:
+		return tilemap.Rand.Float64()
+	default:
+		return slot.Entropy() + tilemap.Rand.Float64()*EntropyNoise
+	}
+}
+
+// Rank of the given point on a spiral around the center of the map:
+// first by ring (distance from the center), then clockwise by angle.
+func (tilemap *Tilemap) SpiralRank(point Point) float64 {
+	dx := float64(point.X) - float64(tilemap.Width-1)/2
+	dy := float64(point.Y) - float64(tilemap.Height-1)/2
+
+	ring := math.Ceil(math.Max(math.Abs(dx), math.Abs(dy)))
+
+	// angle in the range [0, 1), starting north, going clockwise
+	angle := math.Atan2(dx, -dy)
+	if angle < 0 {
+		angle += 2 * math.Pi
+	}
+
+	return ring + angle/(2*math.Pi)
+}
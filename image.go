@@ -6,6 +6,8 @@ import (
 	"image"
 	"image/png"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type Point image.Point
@@ -25,6 +27,13 @@ func SavePNG(filename string, img image.Image) error {
 	return nil
 }
 
+// insert a number before the extension, e.g. out.png => out-3.png
+func NumberedFilename(filename string, number int) string {
+	extension := filepath.Ext(filename)
+
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(filename, extension), number, extension)
+}
+
 // check if an image is completely transparent
 func ImageIsTransparent(tile image.Image) bool {
 	for y := tile.Bounds().Min.Y; y < tile.Bounds().Dy(); y++ {
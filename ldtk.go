@@ -4,12 +4,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/solarlune/ldtkgo"
 )
 
 type LDTKProject struct {
 	Directory string
+	Filename  string
+	Data      []byte // raw JSON, modified by the level writer
 	Project   *ldtkgo.Project
 }
 
@@ -107,7 +112,12 @@ func LDTKLoadProjectFile(file string) (*LDTKProject, error) {
 
 	basepath := filepath.Dir(file)
 
-	return &LDTKProject{Project: ldtkproject, Directory: basepath}, nil
+	return &LDTKProject{
+		Project:   ldtkproject,
+		Directory: basepath,
+		Filename:  file,
+		Data:      buffer,
+	}, nil
 }
 
 func LDTKGetCellsize(project *LDTKProject, identifier string) int {
@@ -130,9 +140,13 @@ func LDTKGetCellsize(project *LDTKProject, identifier string) int {
 	return 0
 }
 
-// load superposition tile array from named LDTK level
-func LDTKLoadLevel(project *LDTKProject, identifier string, checkpoints int) (Superposition, error) {
+// load superposition tile array from named LDTK level, also returns
+// the level as sample grid of superposition indices
+func LDTKLoadLevel(project *LDTKProject, identifier string, matcher *EdgeMatcher) (Superposition, *Sample, error) {
 	superposition := Superposition{}
+	registry := map[string]*Tile{}
+	explicit := map[string]bool{}
+	var sample *Sample
 
 	level := &ldtkgo.Level{}
 
@@ -151,7 +165,11 @@ func LDTKLoadLevel(project *LDTKProject, identifier string, checkpoints int) (Su
 
 			tilemap, err := Loadimage(project.Directory + "/" + tileset.Path)
 			if err != nil {
-				return nil, fmt.Errorf("failed to load tileset %s: %w", tileset.Path, err)
+				return nil, nil, fmt.Errorf("failed to load tileset %s: %w", tileset.Path, err)
+			}
+
+			if sample == nil {
+				sample = NewSample(layer.CellWidth, layer.CellHeight)
 			}
 
 			for _, tileData := range layer.AllTiles() {
@@ -163,16 +181,71 @@ func LDTKLoadLevel(project *LDTKProject, identifier string, checkpoints int) (Su
 					layer.GridSize,
 					layer.GridSize)
 				if err != nil {
-					return nil, fmt.Errorf("failed to load subimage from %s: %w", tileset.Path, err)
+					return nil, nil, fmt.Errorf("failed to load subimage from %s: %w", tileset.Path, err)
+				}
+
+				id, err := GetImageHash(tileimage)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				// upper layers come first and cover the ones below
+				x, y := layer.ToGridPosition(tileData.Position[0], tileData.Position[1])
+
+				if Exists(registry, id) {
+					// the same tile painted multiple times increases
+					// its weight instead of adding a duplicate
+					if !explicit[id] {
+						registry[id].Weight++
+					}
+
+					sample.Place(x, y, registry[id].Index)
+					continue
+				}
+
+				tile, err := NewTile(tileimage, matcher)
+				if err != nil {
+					return nil, nil, err
+				}
+
+				// remember where the tile came from, so that we are able
+				// to write it back into an LDTK level
+				tile.TileId = tileData.ID
+				tile.TilesetUid = tileset.ID
+				tile.Src = Point{X: tileData.Src[0], Y: tileData.Src[1]}
+				tile.Weight = 1
+
+				// an explicit weight maintained in LDTK takes precedence
+				if weight, ok := LDTKTileWeight(tileset, tileData.ID); ok {
+					tile.Weight = weight
+					explicit[id] = true
+				}
+
+				// so do sockets instead of the pixel edges
+				sockets, err := LDTKTileSockets(tileset, tileData.ID)
+				if err != nil {
+					return nil, nil, err
 				}
 
-				tile, err := NewTile(tileimage, checkpoints)
+				if sockets != nil {
+					tile.Constraints = sockets
+					tile.Sockets = true
+				}
+
+				tile.Type, tile.Tags = LDTKTileTags(tileset, tileData.ID)
+
+				tile.Symmetry, err = LDTKTileSymmetry(tileset, tileData.ID)
 				if err != nil {
-					return nil, nil
+					return nil, nil, err
 				}
 
+				tile.Index = len(superposition)
+
+				registry[id] = tile
 				superposition = append(superposition, tile)
 
+				sample.Place(x, y, tile.Index)
+
 				if DEBUG {
 					file := fmt.Sprintf("images/tile-debug-%d-%d.png",
 						tileData.Src[0],
@@ -184,5 +257,293 @@ func LDTKLoadLevel(project *LDTKProject, identifier string, checkpoints int) (Su
 		}
 	}
 
-	return superposition, nil
+	if sample == nil {
+		return nil, nil, fmt.Errorf("level %s has no tile layer", identifier)
+	}
+
+	if len(superposition) == 0 {
+		return nil, nil, fmt.Errorf("level %s has no tiles to learn from", identifier)
+	}
+
+	return superposition, sample, nil
+}
+
+// load the tiles placed in the named LDTK level, keyed by their grid
+// position. Used to pre-populate the output map.
+func LDTKLoadSeedTiles(project *LDTKProject, identifier string) (map[Point]*Tile, error) {
+	tiles := map[Point]*Tile{}
+
+	level := project.Project.LevelByIdentifier(identifier)
+	if level == nil {
+		return nil, fmt.Errorf("level %s not found in project", identifier)
+	}
+
+	for _, layer := range level.Layers {
+		switch layer.Type {
+		case ldtkgo.LayerTypeTile:
+			tileset := layer.Tileset
+
+			tilemap, err := Loadimage(project.Directory + "/" + tileset.Path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load tileset %s: %w", tileset.Path, err)
+			}
+
+			for _, tileData := range layer.AllTiles() {
+				// upper layers come first and cover the ones below
+				x, y := layer.ToGridPosition(tileData.Position[0], tileData.Position[1])
+				if Exists(tiles, Point{X: x, Y: y}) {
+					continue
+				}
+
+				tileimage, err := GetTileFromSpriteSheet(
+					tilemap,
+					tileData.Src[0],
+					tileData.Src[1],
+					layer.GridSize,
+					layer.GridSize)
+				if err != nil {
+					return nil, fmt.Errorf("failed to load subimage from %s: %w", tileset.Path, err)
+				}
+
+				// flipped tiles match the according variant
+				transform := TransformFromLDTKFlip(tileData.Flip)
+				if transform != (Transform{}) {
+					tileimage = transform.Image(tileimage)
+				}
+
+				id, err := GetImageHash(tileimage)
+				if err != nil {
+					return nil, err
+				}
+
+				tiles[Point{X: x, Y: y}] = &Tile{
+					Id:         id,
+					Image:      tileimage,
+					TileId:     tileData.ID,
+					TilesetUid: tileset.ID,
+					Src:        Point{X: tileData.Src[0], Y: tileData.Src[1]},
+					Transform:  transform,
+				}
+			}
+		}
+	}
+
+	return tiles, nil
+}
+
+// Parse  the custom  data LDTK  stores for  a tile. We  expect space
+// separated key:value  pairs, e.g. "weight:5". Keys  are case
+// insensitive, anything else is ignored.
+func ParseCustomData(data string) map[string]string {
+	values := map[string]string{}
+
+	for _, field := range strings.Fields(data) {
+		key, value, found := strings.Cut(field, ":")
+		if !found || key == "" {
+			continue
+		}
+
+		values[strings.ToLower(key)] = value
+	}
+
+	return values
+}
+
+// matches enum values like Weight_5 or weight10
+var enumweight = regexp.MustCompile(`^(?i)weight_?(\d+)$`)
+
+// Returns the weight configured for the given tile in LDTK, either as
+// custom data "weight:N" or using an enum value "Weight_N"
+func LDTKTileWeight(tileset *ldtkgo.Tileset, tileid int) (float64, bool) {
+	customdata := ParseCustomData(tileset.CustomDataForTile(tileid))
+
+	if Exists(customdata, "weight") {
+		weight, err := strconv.ParseFloat(customdata["weight"], 64)
+		if err == nil && weight >= 0 {
+			return weight, true
+		}
+	}
+
+	for _, enum := range tileset.EnumsForTile(tileid) {
+		match := enumweight.FindStringSubmatch(enum)
+		if match != nil {
+			weight, _ := strconv.ParseFloat(match[1], 64)
+			return weight, true
+		}
+	}
+
+	return 0, false
+}
+
+// Returns the sockets configured for the given tile in LDTK as custom
+// data, e.g. "N:grass E:road S:grass W:road" (or north:grass etc), one
+// per direction. Returns nil if the tile has no sockets at all.
+func LDTKTileSockets(tileset *ldtkgo.Tileset, tileid int) ([]string, error) {
+	customdata := ParseCustomData(tileset.CustomDataForTile(tileid))
+	sockets := make([]string, 4)
+	found := 0
+
+	for _, direction := range Directions {
+		name := DirectionNames[direction]
+
+		long, short := Exists(customdata, name), Exists(customdata, name[:1])
+
+		switch {
+		case long && short:
+			return nil, fmt.Errorf("tile %d of tileset %s: socket of side %s given twice, as %s and %s",
+				tileid, tileset.Identifier, name, name, name[:1])
+		case long:
+			sockets[direction] = customdata[name]
+			found++
+		case short:
+			sockets[direction] = customdata[name[:1]]
+			found++
+		}
+	}
+
+	switch found {
+	case 0:
+		return nil, nil
+	case 4:
+		return sockets, nil
+	}
+
+	return nil, fmt.Errorf("tile %d of tileset %s: sockets for all 4 sides required, got %q",
+		tileid, tileset.Identifier, tileset.CustomDataForTile(tileid))
+}
+
+// Returns the type and the tags of  the given tile in LDTK. Tags are the
+// enum values  assigned to the tile (except weights), the type is taken
+// from the custom data "type:name", the first tag otherwise.
+func LDTKTileTags(tileset *ldtkgo.Tileset, tileid int) (string, []string) {
+	customdata := ParseCustomData(tileset.CustomDataForTile(tileid))
+	tags := []string{}
+
+	for _, enum := range tileset.EnumsForTile(tileid) {
+		if !enumweight.MatchString(enum) {
+			tags = append(tags, enum)
+		}
+	}
+
+	switch {
+	case Exists(customdata, "type"):
+		return customdata["type"], tags
+	case len(tags) > 0:
+		return tags[0], tags
+	}
+
+	return "", tags
+}
+
+// Returns the symmetry class configured  for the given tile in LDTK as
+// custom data "symmetry:L", empty if there is none
+func LDTKTileSymmetry(tileset *ldtkgo.Tileset, tileid int) (string, error) {
+	customdata := ParseCustomData(tileset.CustomDataForTile(tileid))
+
+	if !Exists(customdata, "symmetry") {
+		return "", nil
+	}
+
+	if err := CheckSymmetryClass(customdata["symmetry"]); err != nil {
+		return "", fmt.Errorf("tile %d of tileset %s: %w", tileid, tileset.Identifier, err)
+	}
+
+	return customdata["symmetry"], nil
+}
+
+// Load a generation mask from an IntGrid layer of the named LDTK level,
+// the first one if layername is empty. Cells with value 0 are unused.
+func LDTKLoadMask(project *LDTKProject, identifier, layername string, width, height int) (*Mask, error) {
+	level := project.Project.LevelByIdentifier(identifier)
+	if level == nil {
+		return nil, fmt.Errorf("mask level %s not found in project", identifier)
+	}
+
+	for _, layer := range level.Layers {
+		if layer.Type != ldtkgo.LayerTypeIntGrid {
+			continue
+		}
+
+		if layername != "" && layer.Identifier != layername {
+			continue
+		}
+
+		used := map[Point]bool{}
+		for _, integer := range layer.IntGrid {
+			x, y := layer.ToGridPosition(integer.Position[0], integer.Position[1])
+			used[Point{X: x, Y: y}] = integer.Value != 0
+		}
+
+		return NewMask(width, height, layer.CellWidth, layer.CellHeight, func(x, y int) bool {
+			return used[Point{X: x, Y: y}]
+		}), nil
+	}
+
+	if layername != "" {
+		return nil, fmt.Errorf("mask level %s has no IntGrid layer %s", identifier, layername)
+	}
+
+	return nil, fmt.Errorf("mask level %s has no IntGrid layer", identifier)
+}
+
+// Return the size of the named level in cells of its first tile layer
+func LDTKLevelCells(projectname, identifier string) (int, int, error) {
+	project, err := LDTKLoadProjectFile(projectname)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	level := project.Project.LevelByIdentifier(identifier)
+	if level == nil {
+		return 0, 0, fmt.Errorf("level %s not found in project", identifier)
+	}
+
+	for _, layer := range level.Layers {
+		if layer.Type == ldtkgo.LayerTypeTile {
+			return layer.CellWidth, layer.CellHeight, nil
+		}
+	}
+
+	return 0, 0, fmt.Errorf("level %s has no tile layer", identifier)
+}
+
+// Regenerating writes the tiles of each tileset into its first tile
+// layer, so other tile layers would be merged into it. Return an error
+// if the named level has more than one tile layer per tileset or tiles
+// of different layers cover each other.
+func LDTKCheckTileLayers(project *LDTKProject, identifier string) error {
+	level := project.Project.LevelByIdentifier(identifier)
+	if level == nil {
+		return fmt.Errorf("level %s not found in project", identifier)
+	}
+
+	tilesets := map[int]string{}
+	cells := map[Point]string{}
+
+	for _, layer := range level.Layers {
+		if layer.Type != ldtkgo.LayerTypeTile {
+			continue
+		}
+
+		if other, ok := tilesets[layer.Tileset.ID]; ok {
+			return fmt.Errorf("level %s has more than one tile layer using tileset %s (%s, %s)",
+				identifier, layer.Tileset.Path, other, layer.Identifier)
+		}
+
+		tilesets[layer.Tileset.ID] = layer.Identifier
+
+		for _, tileData := range layer.AllTiles() {
+			x, y := layer.ToGridPosition(tileData.Position[0], tileData.Position[1])
+			point := Point{X: x, Y: y}
+
+			if other, ok := cells[point]; ok && other != layer.Identifier {
+				return fmt.Errorf("tiles of layers %s and %s of level %s overlap at %d,%d",
+					other, layer.Identifier, identifier, x, y)
+			}
+
+			cells[point] = layer.Identifier
+		}
+	}
+
+	return nil
 }
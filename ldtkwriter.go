@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// One entry of the gridTiles array of an LDTK tile layer
+type LDTKGridTile struct {
+	Position []int   `json:"px"`  // pixel position on the target level
+	Src      []int   `json:"src"` // pixel position of the tile inside the tileset
+	Flip     byte    `json:"f"`   // flip bits, 1 = X, 2 = Y
+	TileId   int     `json:"t"`   // id of the source tile
+	Data     []int   `json:"d"`   // internal LDTK data, coordId of the tile
+	Alpha    float64 `json:"a"`
+}
+
+// A JSON key and value to be set with sjson, order matters
+type LDTKField struct {
+	Key   string
+	Value any
+}
+
+// set all fields below prefix of the given JSON document
+func LDTKSetFields(document, prefix string, fields []LDTKField) (string, error) {
+	var err error
+
+	for _, field := range fields {
+		document, err = sjson.Set(document, prefix+field.Key, field.Value)
+		if err != nil {
+			return "", fmt.Errorf("failed to set %s%s: %w", prefix, field.Key, err)
+		}
+	}
+
+	return document, nil
+}
+
+// generate a new random iid (UUID v4) as used by LDTK
+func LDTKNewIid() (string, error) {
+	uuid := make([]byte, 16)
+
+	if _, err := rand.Read(uuid); err != nil {
+		return "", fmt.Errorf("failed to generate iid: %w", err)
+	}
+
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x",
+		uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
+// Find a free spot in the world for a new level. We just put it right
+// next to the rightmost level, which can never overlap with any other
+// level.
+func LDTKFreeWorldPosition(data []byte) (int, int) {
+	layout := gjson.GetBytes(data, "worldLayout").String()
+
+	switch layout {
+	case "LinearHorizontal", "LinearVertical":
+		// LDTK doesn't use coordinates in linear layouts
+		return -1, -1
+	}
+
+	right := 0
+	gap := int(gjson.GetBytes(data, "defaultGridSize").Int())
+
+	for _, level := range gjson.GetBytes(data, "levels").Array() {
+		end := int(level.Get("worldX").Int() + level.Get("pxWid").Int())
+		if end > right {
+			right = end
+		}
+	}
+
+	posx := right + gap
+
+	if layout == "GridVania" {
+		// levels must be aligned to the world grid
+		grid := int(gjson.GetBytes(data, "worldGridWidth").Int())
+		if grid > 0 {
+			posx = ((right + grid - 1) / grid) * grid
+		}
+	}
+
+	return posx, 0
+}
+
+// Convert the collapsed tilemap into the gridTiles  of a tile layer,
+// using only tiles from the given tileset.
+func LDTKGridTiles(tilemap *Tilemap, cellsize, tilesetuid, cwidth int) ([]LDTKGridTile, error) {
+	tiles := []LDTKGridTile{}
+
+	for y := 0; y < tilemap.Height; y++ {
+		for x := 0; x < tilemap.Width; x++ {
+			slot, ok := tilemap.Slots[Point{X: x, Y: y}]
+			if !ok {
+				// masked cells stay empty
+				continue
+			}
+
+			tile := slot.GetTile()
+
+			if tile.TilesetUid != tilesetuid {
+				continue
+			}
+
+			flip, err := tile.Transform.LDTKFlip()
+			if err != nil {
+				return nil, fmt.Errorf("tile %d at position %d,%d: %w", tile.TileId, x, y, err)
+			}
+
+			tiles = append(tiles, LDTKGridTile{
+				Position: []int{x * cellsize, y * cellsize},
+				Src:      []int{tile.Src.X, tile.Src.Y},
+				Flip:     flip,
+				TileId:   tile.TileId,
+				Data:     []int{x + y*cwidth},
+				Alpha:    1,
+			})
+		}
+	}
+
+	return tiles, nil
+}
+
+// Replace the tiles of the named level by the given collapsed tilemap.
+// Only the first tile layer of each tileset is being rewritten, all
+// other layers, entities and fields are left as they are.
+func LDTKUpdateLevel(project *LDTKProject, identifier string, tilemap *Tilemap, cellsize int) error {
+	data := project.Data
+
+	if !tilemap.Collapsed() {
+		return errors.New("refusing to write a tilemap which is not collapsed")
+	}
+
+	if gjson.GetBytes(data, "externalLevels").Bool() {
+		return errors.New("projects with external levels are not supported")
+	}
+
+	index := -1
+
+	for idx, level := range gjson.GetBytes(data, "levels").Array() {
+		if level.Get("identifier").String() == identifier {
+			index = idx
+			break
+		}
+	}
+
+	if index < 0 {
+		return fmt.Errorf("level %s not found in project", identifier)
+	}
+
+	prefix := "levels." + strconv.Itoa(index) + "."
+	written := map[int]bool{}
+
+	for idx, layer := range gjson.GetBytes(data, prefix+"layerInstances").Array() {
+		tilesetuid := int(layer.Get("__tilesetDefUid").Int())
+
+		if layer.Get("__type").String() != "Tiles" || written[tilesetuid] {
+			continue
+		}
+
+		if gridsize := int(layer.Get("__gridSize").Int()); gridsize != cellsize {
+			return fmt.Errorf("grid size of layer %s (%d) differs from cell size %d",
+				layer.Get("__identifier").String(), gridsize, cellsize)
+		}
+
+		gridtiles, err := LDTKGridTiles(tilemap, cellsize, tilesetuid, int(layer.Get("__cWid").Int()))
+		if err != nil {
+			return err
+		}
+
+		raw, err := json.Marshal(gridtiles)
+		if err != nil {
+			return fmt.Errorf("failed to update level %s: %w", identifier, err)
+		}
+
+		// levels, layerInstances and gridTiles are nested 5 levels deep
+		if !gjson.GetBytes(data, "minifyJson").Bool() {
+			raw = []byte(LDTKFormat(gjson.ParseBytes(raw), 5))
+		}
+
+		data, err = sjson.SetRawBytes(data, prefix+"layerInstances."+strconv.Itoa(idx)+".gridTiles", raw)
+		if err != nil {
+			return fmt.Errorf("failed to update level %s: %w", identifier, err)
+		}
+
+		written[tilesetuid] = true
+	}
+
+	for _, slot := range tilemap.Slotlist {
+		if !written[slot.GetTile().TilesetUid] {
+			return fmt.Errorf("level %s has no tile layer for tileset uid %d",
+				identifier, slot.GetTile().TilesetUid)
+		}
+	}
+
+	project.Data = data
+
+	return nil
+}
+
+// Add the given  collapsed tilemap as a new level  to the project, at
+// a free spot of the world, see LDTKAddLevelAt()
+func LDTKAddLevel(project *LDTKProject, template, identifier string,
+	tilemap *Tilemap, cellsize int) error {
+	worldx, worldy := LDTKFreeWorldPosition(project.Data)
+
+	return LDTKAddLevelAt(project, template, identifier, tilemap, cellsize, worldx, worldy)
+}
+
+// Add the given  collapsed tilemap as a new level  to the project. The
+// level named  template is being  used as blueprint for  the layers,
+// fields  and background  of the  new  level, but  all its  contents
+// (tiles, entities, intgrids) are removed.
+func LDTKAddLevelAt(project *LDTKProject, template, identifier string,
+	tilemap *Tilemap, cellsize, worldx, worldy int) error {
+	data := project.Data
+
+	if !tilemap.Collapsed() {
+		return errors.New("refusing to write a tilemap which is not collapsed")
+	}
+
+	if gjson.GetBytes(data, "externalLevels").Bool() {
+		return errors.New("projects with external levels are not supported")
+	}
+
+	if len(gjson.GetBytes(data, "worlds").Array()) > 0 {
+		return errors.New("projects with multiple worlds are not supported")
+	}
+
+	var blueprint string
+
+	for _, level := range gjson.GetBytes(data, "levels").Array() {
+		switch level.Get("identifier").String() {
+		case identifier:
+			return fmt.Errorf("level %s already exists in project", identifier)
+		case template:
+			blueprint = level.Raw
+		}
+	}
+
+	if blueprint == "" {
+		return fmt.Errorf("template level %s not found in project", template)
+	}
+
+	uid := int(gjson.GetBytes(data, "nextUid").Int())
+	pxwidth := tilemap.Width * cellsize
+	pxheight := tilemap.Height * cellsize
+
+	iid, err := LDTKNewIid()
+	if err != nil {
+		return err
+	}
+
+	level, err := LDTKSetFields(blueprint, "", []LDTKField{
+		{"identifier", identifier},
+		{"iid", iid},
+		{"uid", uid},
+		{"worldX", worldx},
+		{"worldY", worldy},
+		{"pxWid", pxwidth},
+		{"pxHei", pxheight},
+		{"useAutoIdentifier", false},
+		{"__neighbours", []any{}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to setup level %s: %w", identifier, err)
+	}
+
+	// tiles of each tileset are only being written once
+	written := map[int]bool{}
+
+	for idx, layer := range gjson.Get(level, "layerInstances").Array() {
+		path := "layerInstances." + strconv.Itoa(idx) + "."
+
+		gridsize := int(layer.Get("__gridSize").Int())
+		if gridsize == 0 {
+			return fmt.Errorf("layer %s has no grid size", layer.Get("__identifier").String())
+		}
+
+		cwidth := (pxwidth + gridsize - 1) / gridsize
+		cheight := (pxheight + gridsize - 1) / gridsize
+
+		layeriid, err := LDTKNewIid()
+		if err != nil {
+			return err
+		}
+
+		gridtiles := []LDTKGridTile{}
+		tilesetuid := int(layer.Get("__tilesetDefUid").Int())
+
+		// only IntGrid layers have values, all of them 0 (empty)
+		intgrid := []int{}
+		if layer.Get("__type").String() == "IntGrid" {
+			intgrid = make([]int, cwidth*cheight)
+		}
+
+		if layer.Get("__type").String() == "Tiles" && !written[tilesetuid] {
+			if gridsize != cellsize {
+				return fmt.Errorf("grid size of layer %s (%d) differs from cell size %d",
+					layer.Get("__identifier").String(), gridsize, cellsize)
+			}
+
+			gridtiles, err = LDTKGridTiles(tilemap, cellsize, tilesetuid, cwidth)
+			if err != nil {
+				return err
+			}
+			written[tilesetuid] = true
+		}
+
+		level, err = LDTKSetFields(level, path, []LDTKField{
+			{"__cWid", cwidth},
+			{"__cHei", cheight},
+			{"iid", layeriid},
+			{"levelId", uid},
+			{"gridTiles", gridtiles},
+			{"autoLayerTiles", []any{}},
+			{"entityInstances", []any{}},
+			{"intGridCsv", intgrid},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to setup layer %d of level %s: %w", idx, identifier, err)
+		}
+	}
+
+	// make sure there's no tile left without a layer
+	for _, slot := range tilemap.Slotlist {
+		if !written[slot.GetTile().TilesetUid] {
+			return fmt.Errorf("template level %s has no tile layer for tileset uid %d",
+				template, slot.GetTile().TilesetUid)
+		}
+	}
+
+	data, err = LDTKAppendLevel(data, level)
+	if err != nil {
+		return fmt.Errorf("failed to add level %s to project: %w", identifier, err)
+	}
+
+	data, err = sjson.SetBytes(data, "nextUid", uid+1)
+	if err != nil {
+		return fmt.Errorf("failed to update nextUid: %w", err)
+	}
+
+	project.Data = data
+
+	return nil
+}
+
+// Append the level to the levels of the project. Unless the project is
+// minified, the level is formatted like LDTK does and the rest of the
+// file is left as it is.
+func LDTKAppendLevel(data []byte, level string) ([]byte, error) {
+	if gjson.GetBytes(data, "minifyJson").Bool() {
+		return sjson.SetRawBytes(data, "levels.-1", []byte(level))
+	}
+
+	levels := gjson.GetBytes(data, "levels")
+	if !levels.IsArray() || levels.Index == 0 {
+		return nil, errors.New("project has no levels array")
+	}
+
+	// levels are nested 2 levels deep
+	formatted := LDTKFormat(gjson.Parse(level), 2)
+
+	var result bytes.Buffer
+
+	elements := levels.Array()
+	if len(elements) == 0 {
+		result.Write(data[:levels.Index])
+		result.WriteString("[\n\t\t" + formatted + "\n\t]")
+		result.Write(data[levels.Index+len(levels.Raw):])
+	} else {
+		last := elements[len(elements)-1]
+		end := last.Index + len(last.Raw)
+
+		if last.Index == 0 || end > len(data) || string(data[last.Index:end]) != last.Raw {
+			return nil, errors.New("failed to locate the last level of the project")
+		}
+
+		result.Write(data[:end])
+		result.WriteString(",\n\t\t" + formatted)
+		result.Write(data[end:])
+	}
+
+	return result.Bytes(), nil
+}
+
+// Maximum length of an object kept on one line by LDTKFormat()
+const LDTKInlineLength = 120
+
+// Format  a JSON value the  way LDTK does: objects and arrays of objects
+// span multiple lines indented by tabs, arrays of plain values and
+// short flat objects inside of arrays (e.g. grid tiles) are kept on
+// one line.
+// depth is the indentation of the line the value starts on.
+func LDTKFormat(value gjson.Result, depth int) string {
+	indent := strings.Repeat("\t", depth+1)
+	parts := []string{}
+
+	switch {
+	case value.IsArray():
+		elements := value.Array()
+		if len(elements) == 0 {
+			return "[]"
+		}
+
+		if !LDTKNested(value) {
+			for _, element := range elements {
+				parts = append(parts, element.Raw)
+			}
+
+			return "[" + strings.Join(parts, ",") + "]"
+		}
+
+		for _, element := range elements {
+			if element.IsObject() && !LDTKNested(element) {
+				members := []string{}
+				element.ForEach(func(key, member gjson.Result) bool {
+					members = append(members, key.Raw+": "+LDTKFormat(member, depth+1))
+					return true
+				})
+
+				if inline := "{ " + strings.Join(members, ", ") + " }"; len(inline) <= LDTKInlineLength {
+					parts = append(parts, indent+inline)
+					continue
+				}
+			}
+
+			parts = append(parts, indent+LDTKFormat(element, depth+1))
+		}
+
+		return "[\n" + strings.Join(parts, ",\n") + "\n" + indent[1:] + "]"
+	case value.IsObject():
+		value.ForEach(func(key, member gjson.Result) bool {
+			parts = append(parts, indent+key.Raw+": "+LDTKFormat(member, depth+1))
+			return true
+		})
+
+		if len(parts) == 0 {
+			return "{}"
+		}
+
+		return "{\n" + strings.Join(parts, ",\n") + "\n" + indent[1:] + "}"
+	}
+
+	return value.Raw
+}
+
+// Return true if the value contains objects or arrays of non-plain values
+func LDTKNested(value gjson.Result) bool {
+	nested := false
+
+	value.ForEach(func(_, member gjson.Result) bool {
+		if member.IsObject() || (member.IsArray() && LDTKNested(member)) {
+			nested = true
+		}
+
+		return !nested
+	})
+
+	return nested
+}
+
+// Write the (modified)  project back to disk. The  previous version is
+// kept as a backup with a .bak suffix. The new file is written into a
+// temporary file first and then renamed, so  we never leave a broken
+// project behind.
+func LDTKSaveProject(project *LDTKProject) error {
+	data := project.Data
+
+	if !gjson.ValidBytes(data) {
+		return errors.New("refusing to write invalid JSON to LDTK project")
+	}
+
+	original, err := os.ReadFile(project.Filename)
+	if err != nil {
+		return fmt.Errorf("failed to read LDTK file %s: %w", project.Filename, err)
+	}
+
+	if err := os.WriteFile(project.Filename+".bak", original, 0644); err != nil {
+		return fmt.Errorf("failed to write backup of LDTK file %s: %w", project.Filename, err)
+	}
+
+	return WriteFileAtomic(project.Filename, data)
+}
+
+// write data into a temporary file next to filename and rename it
+func WriteFileAtomic(filename string, data []byte) error {
+	fd, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for %s: %w", filename, err)
+	}
+
+	tmpname := fd.Name()
+
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+
+	if closeerr := fd.Close(); err == nil {
+		err = closeerr
+	}
+
+	if err != nil {
+		os.Remove(tmpname)
+		return fmt.Errorf("failed to write %s: %w", tmpname, err)
+	}
+
+	if fileinfo, err := os.Stat(filename); err == nil {
+		os.Chmod(tmpname, fileinfo.Mode())
+	}
+
+	if err := os.Rename(tmpname, filename); err != nil {
+		os.Remove(tmpname)
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpname, filename, err)
+	}
+
+	return nil
+}
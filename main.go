@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	_ "image/png"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 )
 
 func Die(err error) int {
@@ -36,21 +38,158 @@ func Main(output io.Writer) int {
 		Die(fmt.Errorf("mandatory parameters -p and -l missing"))
 	}
 
-	wave, err := NewWaveFromProject(conf.Project, conf.Level, conf.Width, conf.Height, conf.Checkpoints)
+	// allow to cancel generation with ^C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if conf.Command == CommandAnalyze || conf.Autotune {
+		results, err := Analyze(ctx, conf.Project, conf.Level, conf.Model, conf.Seed)
+		if err != nil {
+			return Die(err)
+		}
+
+		if conf.Command == CommandAnalyze {
+			PrintAnalysis(output, results)
+			return 0
+		}
+
+		best := BestAnalysis(results).Edges
+		conf.Model.Edges = best
+		conf.Checkpoints = best.Checkpoints
+
+		fmt.Fprintf(output, "autotune: using --edges %s --checkpoints %d\n", best.Strategy, best.Checkpoints)
+	}
+
+	seedlevel := conf.Seedlevel
+
+	// the level being regenerated determines the size, it is pinned
+	// later on, except for the region
+	if conf.Command == CommandRegenerate {
+		conf.Width, conf.Height, err = LDTKLevelCells(conf.Project, conf.Seedlevel)
+		if err != nil {
+			return Die(err)
+		}
+
+		seedlevel = ""
+	}
+
+	// the seed level is pinned once the mask is set, see Wave.SetMask()
+	if conf.Mask != "" {
+		seedlevel = ""
+	}
+
+	// the wave covers the whole world, see world.go
+	if conf.WorldSize != "" {
+		conf.Width *= conf.World.Columns
+		conf.Height *= conf.World.Rows
+	}
+
+	wave, err := NewWaveFromProject(conf.Project, conf.Level, seedlevel, conf.Width, conf.Height, conf.Checkpoints, conf.Model)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if conf.Mask != "" && conf.Command != CommandRegenerate {
+		mask, err := wave.LoadMask(conf.Mask)
+		if err != nil {
+			return Die(err)
+		}
+
+		wave.Seedlevel = conf.Seedlevel
+
+		if err := wave.SetMask(mask); err != nil {
+			return Die(err)
+		}
+	}
+
+	if conf.Command == CommandRegenerate {
+		if err := wave.Inpaint(conf.Seedlevel, conf.Region, conf.Mask); err != nil {
+			return Die(err)
+		}
+	}
+
+	wave.Heuristic = conf.Heuristic
+	wave.Strategy = conf.Strategy
+	wave.Solver = conf.Solver
+	wave.Periodic = conf.Periodic
+	wave.Retries = conf.Retries
+	wave.Restarts = conf.Restarts
+	wave.RestartMode = conf.RestartMode
+	wave.Timeout = conf.Timeout
+
+	if conf.SeedGiven {
+		wave.SetSeed(conf.Seed)
+	}
+
+	err = wave.SetWeights(conf.TileWeights)
+	if err != nil {
+		Die(err)
+	}
+
+	if err := wave.SetBorders(conf.Borders); err != nil {
+		return Die(err)
+	}
+
 	if conf.Debug {
 		fmt.Println("Superposition:")
 		for _, tile := range wave.Superposition {
 			fmt.Println(tile.Dump())
 		}
+
+		fmt.Println("Adjacency:")
+		wave.Adjacency.Dump()
 	}
 
-	err = wave.Collapse(100)
+	if conf.Command == CommandDiagnose {
+		diagnosis, err := wave.Diagnose(conf.Preview)
+		if err != nil {
+			return Die(err)
+		}
+
+		if err := diagnosis.Print(output, conf.Format); err != nil {
+			return Die(err)
+		}
+
+		return 0
+	}
+
+	if conf.Solutions >= 0 {
+		count, err := wave.Enumerate(ctx, conf.Solutions, func(solution int) error {
+			if conf.Outputimage == "" {
+				return nil
+			}
+
+			return wave.Export(NumberedFilename(conf.Outputimage, solution))
+		})
+		if err != nil {
+			return Die(err)
+		}
+
+		fmt.Fprintf(output, "Solutions: %d", count)
+		if conf.Solutions > 0 && count == conf.Solutions {
+			fmt.Fprint(output, " (limit reached)")
+		}
+		fmt.Fprintln(output)
+
+		return 0
+	}
+
+	err = wave.CollapseContext(ctx)
 	if err != nil {
-		Die(err)
+		if wave.Contradiction != nil {
+			fmt.Fprint(output, wave.Contradiction.Explain())
+
+			// the highlighted map helps finding the failing area
+			if conf.Outputimage != "" {
+				if err := wave.Export(conf.Outputimage); err != nil {
+					log.Printf("failed to render: %s", err)
+				} else {
+					fmt.Fprintf(output, "Failing area highlighted in %s\n", conf.Outputimage)
+				}
+			}
+		}
+
+		return Die(err)
 	}
 
 	if conf.Outputimage != "" {
@@ -60,6 +199,23 @@ func Main(output io.Writer) int {
 		}
 	}
 
+	if conf.Command == CommandRegenerate {
+		err = wave.ExportRegenerated(conf.Seedlevel, conf.Outputlevel)
+		if err != nil {
+			log.Fatalf("failed to write LDTK level: %s", err)
+		}
+	} else if conf.WorldSize != "" {
+		err = wave.ExportLDTKWorld(conf.Outputlevel, conf.World)
+		if err != nil {
+			log.Fatalf("failed to write LDTK world: %s", err)
+		}
+	} else if conf.Outputlevel != "" {
+		err = wave.ExportLDTK(conf.Outputlevel)
+		if err != nil {
+			log.Fatalf("failed to write LDTK level: %s", err)
+		}
+	}
+
 	wave.OutputTilemap.Printstats()
 	fmt.Println("ok")
 
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+/*
+A mask  restricts  generation  to an arbitrary shape. Masked cells don't
+become slots of the output map, neighbor lookups treat them like the
+edge of the map and they are left transparent on export. A mask is
+either a PNG (black or transparent means unused) or an LDTK IntGrid
+layer (0 means unused). If its size differs from the output map, it is
+scaled to fit.
+*/
+type Mask struct {
+	Width, Height int
+	Cells         []bool // true if the cell is part of the map
+}
+
+// Return a  mask of the given  size, sampled from a source of another
+// size, used reports if a cell of the source is part of the map
+func NewMask(width, height, srcwidth, srcheight int, used func(x, y int) bool) *Mask {
+	mask := &Mask{Width: width, Height: height, Cells: make([]bool, width*height)}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			mask.Cells[y*width+x] = used(x*srcwidth/width, y*srcheight/height)
+		}
+	}
+
+	return mask
+}
+
+// Return true if the point is part of the map
+func (mask *Mask) Used(point Point) bool {
+	if point.X < 0 || point.Y < 0 || point.X >= mask.Width || point.Y >= mask.Height {
+		return false
+	}
+
+	return mask.Cells[point.Y*mask.Width+point.X]
+}
+
+// Load a mask from a PNG file, dark or transparent pixels are unused
+func LoadMaskImage(filename string, width, height int) (*Mask, error) {
+	img, err := Loadimage(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load mask %s: %w", filename, err)
+	}
+
+	bounds := img.Bounds()
+
+	return NewMask(width, height, bounds.Dx(), bounds.Dy(), func(x, y int) bool {
+		color := GetColor(img, bounds.Min.X+x, bounds.Min.Y+y)
+
+		return color[3] >= 128 && int(color[0])+int(color[1])+int(color[2]) >= 3*128
+	}), nil
+}
+
+// Load a mask  of the size of the output map: <file>.png or an LDTK level
+// with an IntGrid layer, <level> (first IntGrid layer) or <level>/<layer>
+func (wave *Wave) LoadMask(spec string) (*Mask, error) {
+	if strings.EqualFold(filepath.Ext(spec), ".png") {
+		return LoadMaskImage(spec, wave.Width, wave.Height)
+	}
+
+	if wave.Project == nil {
+		return nil, errors.New("wave has not been loaded from an LDTK project")
+	}
+
+	level, layer, _ := strings.Cut(spec, "/")
+
+	return LDTKLoadMask(wave.Project, level, layer, wave.Width, wave.Height)
+}
+
+// Restrict generation to the given mask. Slots are set up again, tiles
+// of the seed level are pinned again.
+func (wave *Wave) SetMask(mask *Mask) error {
+	wave.OutputTilemap.Mask = mask
+	wave.OutputTilemap.Populate(wave.Superposition)
+
+	if len(wave.OutputTilemap.Slotlist) == 0 {
+		return errors.New("the mask doesn't leave any cell to generate")
+	}
+
+	if wave.Seedlevel != "" {
+		return wave.Prepopulate(wave.Seedlevel)
+	}
+
+	return nil
+}
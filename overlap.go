@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Models  to learn  the superposition  from the  example level. The
+// simple  model uses  each tile  on its  own and  matches their edges,
+// the overlap model  uses every NxN  window of the level  as a pattern,
+// so that the arrangement of the tiles is being learned as well.
+const (
+	ModelSimple  = "simple"
+	ModelOverlap = "overlap"
+)
+
+var Models = []string{ModelSimple, ModelOverlap}
+
+// Describes how to learn the superposition from the example level
+type Model struct {
+	Name        string      // see above
+	Rules       string      // simple: where the adjacency rules come from, see adjacency.go
+	RuleFile    string      // simple: sockets and pairs maintained by hand, see rulefile.go
+	Variants    string      // simple: rotated/reflected tiles to add, see symmetry.go
+	FlipsOnly   bool        // simple: only add variants LDTK is able to represent
+	Edges       EdgeMatcher // simple: how to compare tile edges, see constraint.go
+	PatternSize int         // overlap: patterns are NxN tiles
+	Symmetry    int         // overlap: number of variants per pattern, 1-8
+}
+
+// check if the given model is usable
+func CheckModel(model Model) error {
+	if !Contains(Models, model.Name) {
+		return fmt.Errorf("unknown model %q, expected one of %v", model.Name, Models)
+	}
+
+	if !Contains(Rules, model.Rules) {
+		return fmt.Errorf("unknown rules %q, expected one of %v", model.Rules, Rules)
+	}
+
+	if !Contains(VariantModes, model.Variants) {
+		return fmt.Errorf("unknown variants mode %q, expected one of %v", model.Variants, VariantModes)
+	}
+
+	if model.Variants == VariantsAuto && (model.Name != ModelSimple || model.Rules != RulesEdges) {
+		return errors.New("tile variants are only supported by the simple model using edge rules")
+	}
+
+	if model.Name == ModelOverlap {
+		if model.Rules != RulesEdges {
+			return errors.New("the overlap model learns its own rules, --rules is not supported")
+		}
+
+		if model.RuleFile != "" {
+			return errors.New("the overlap model learns its own rules, --rule-file is not supported")
+		}
+
+		if model.PatternSize < 2 {
+			return fmt.Errorf("pattern size must be at least 2, got %d", model.PatternSize)
+		}
+
+		if model.Symmetry < 1 || model.Symmetry > 8 {
+			return fmt.Errorf("symmetry must be in the range 1-8, got %d", model.Symmetry)
+		}
+	}
+
+	return nil
+}
+
+// A NxN window of  the example level, holds the superposition indices
+// of the tiles row by row
+type Pattern []int
+
+// Return the pattern rotated by 90 degrees
+func (pattern Pattern) Rotate(size int) Pattern {
+	rotated := make(Pattern, len(pattern))
+
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			rotated[y*size+x] = pattern[x*size+size-1-y]
+		}
+	}
+
+	return rotated
+}
+
+// Return the pattern mirrored horizontally
+func (pattern Pattern) Reflect(size int) Pattern {
+	reflected := make(Pattern, len(pattern))
+
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			reflected[y*size+x] = pattern[y*size+size-1-x]
+		}
+	}
+
+	return reflected
+}
+
+// The transforms of the tiles matching the pattern variants below, a
+// pattern is rotated counterclockwise
+var PatternTransforms = []Transform{
+	{0, false}, {0, true}, {3, false}, {1, true},
+	{2, false}, {2, true}, {1, false}, {3, true},
+}
+
+// Return the  first count variants  of the pattern: the pattern itself,
+// its reflection, then rotated, its reflection and so on. The tiles
+// are only moved, not transformed, see VariantTiles.
+func (pattern Pattern) Variants(size, count int) []Pattern {
+	variants := make([]Pattern, 8)
+
+	variants[0] = pattern
+	variants[1] = pattern.Reflect(size)
+	variants[2] = pattern.Rotate(size)
+	variants[3] = variants[2].Reflect(size)
+	variants[4] = variants[2].Rotate(size)
+	variants[5] = variants[4].Reflect(size)
+	variants[6] = variants[4].Rotate(size)
+	variants[7] = variants[6].Reflect(size)
+
+	return variants[:count]
+}
+
+/*
+Check if  the pattern other may  be placed next to  the pattern in the
+given direction. This is the case if they agree on all overlapping
+tiles, e.g. two 3x3 patterns, other placed east of pattern:
+
+	a b c             b c x
+	d e f   other =>  e f y
+	g h i             h i z
+*/
+func (pattern Pattern) Agrees(other Pattern, size int, direction Direction) bool {
+	offset := (&Point{}).MoveDirection(direction)
+
+	for y := max(0, offset.Y); y < min(size, size+offset.Y); y++ {
+		for x := max(0, offset.X); x < min(size, size+offset.X); x++ {
+			if pattern[y*size+x] != other[(y-offset.Y)*size+x-offset.X] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// The tiles of  the sample and the transformed variants used by rotated
+// and reflected patterns. Variants looking like an existing tile
+// (e.g. of a symmetric tile) are not added.
+type VariantTiles struct {
+	Tiles     Superposition
+	FlipsOnly bool // only variants LDTK is able to represent
+	Matcher   *EdgeMatcher
+	ids       map[string]int      // image id => index of the tile
+	variants  map[tileVariant]int // -1 if the variant can't be used
+}
+
+type tileVariant struct {
+	Index     int
+	Transform Transform
+}
+
+func NewVariantTiles(tiles Superposition, flipsonly bool, matcher *EdgeMatcher) *VariantTiles {
+	variants := &VariantTiles{
+		Tiles:     append(Superposition{}, tiles...),
+		FlipsOnly: flipsonly,
+		Matcher:   matcher,
+		ids:       map[string]int{},
+		variants:  map[tileVariant]int{},
+	}
+
+	for index, tile := range tiles {
+		variants.ids[tile.Id] = index
+	}
+
+	return variants
+}
+
+// Return the index of the given tile transformed, false if LDTK isn't
+// able to represent it
+func (variants *VariantTiles) Index(index int, transform Transform) (int, bool, error) {
+	if transform == (Transform{}) {
+		return index, true, nil
+	}
+
+	key := tileVariant{Index: index, Transform: transform}
+	if known, ok := variants.variants[key]; ok {
+		return known, known >= 0, nil
+	}
+
+	variant, err := variants.Tiles[index].Variant(transform, variants.Matcher)
+	if err != nil {
+		return 0, false, err
+	}
+
+	known, ok := variants.ids[variant.Id]
+
+	switch {
+	case ok:
+		// looks like a tile we already have
+	case variants.FlipsOnly && variant.Transform.Rotation%2 != 0:
+		known = -1
+	default:
+		known = len(variants.Tiles)
+		variants.ids[variant.Id] = known
+		variants.Tiles = append(variants.Tiles, variant)
+	}
+
+	variants.variants[key] = known
+
+	return known, known >= 0, nil
+}
+
+// Extract all  NxN patterns from  the sample, windows containing empty
+// cells are  being ignored. Returns  the unique patterns in  the order
+// of their first appearance and how often each of them occurred. The
+// tiles of rotated and reflected patterns are transformed as well, the
+// variants are added to tiles.
+func ExtractPatterns(sample *Sample, size, symmetry int, tiles *VariantTiles) ([]Pattern, []float64, error) {
+	patterns := []Pattern{}
+	counts := []float64{}
+	registry := map[string]int{}
+
+	for y := 0; y <= sample.Height-size; y++ {
+		for x := 0; x <= sample.Width-size; x++ {
+			pattern := make(Pattern, 0, size*size)
+
+			for py := 0; py < size; py++ {
+				for px := 0; px < size; px++ {
+					pattern = append(pattern, sample.At(x+px, y+py))
+				}
+			}
+
+			if Contains(pattern, -1) {
+				continue
+			}
+
+		variants:
+			for number, variant := range pattern.Variants(size, symmetry) {
+				for i, index := range variant {
+					transformed, ok, err := tiles.Index(index, PatternTransforms[number])
+					if err != nil {
+						return nil, nil, err
+					}
+
+					if !ok {
+						continue variants
+					}
+
+					variant[i] = transformed
+				}
+
+				key := fmt.Sprint(variant)
+
+				if Exists(registry, key) {
+					counts[registry[key]]++
+					continue
+				}
+
+				registry[key] = len(patterns)
+				patterns = append(patterns, variant)
+				counts = append(counts, 1)
+			}
+		}
+	}
+
+	if len(patterns) == 0 {
+		return nil, nil, fmt.Errorf("example level contains no complete %dx%d pattern", size, size)
+	}
+
+	return patterns, counts, nil
+}
+
+// Turn the  patterns into a  new superposition. Each pattern becomes a
+// tile which looks like the top left tile of the pattern and is weighted
+// by the number of occurrences of the pattern.
+func NewOverlapSuperposition(tiles Superposition, patterns []Pattern, counts []float64) Superposition {
+	superposition := make(Superposition, len(patterns))
+
+	for index, pattern := range patterns {
+		tile := *tiles[pattern[0]]
+		tile.Weight = counts[index]
+		tile.Pattern = pattern
+		tile.Index = index
+
+		superposition[index] = &tile
+	}
+
+	return superposition
+}
+
+// Build the index from the patterns  of the tiles: two tiles may be
+// placed next to each other if their patterns agree where they overlap
+func NewAdjacencyFromPatterns(superposition Superposition, size int) *Adjacency {
+	adjacency := NewAdjacency(len(superposition))
+
+	for _, tile := range superposition {
+		for _, direction := range Directions {
+			for _, other := range superposition {
+				if tile.Pattern.Agrees(other.Pattern, size, direction) {
+					adjacency.Rules[tile.Index][direction].Set(other.Index)
+				}
+			}
+		}
+	}
+
+	return adjacency
+}
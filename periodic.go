@@ -0,0 +1,48 @@
+package main
+
+import "fmt"
+
+// Which axes of the output map wrap around. On a wrapping axis the
+// slots at the right (bottom) edge are neighbors of the ones at the
+// left (top) edge, so that the generated map tiles seamlessly.
+const (
+	PeriodicNone = "none"
+	PeriodicX    = "x"
+	PeriodicY    = "y"
+	PeriodicXY   = "xy"
+)
+
+var PeriodicModes = []string{PeriodicNone, PeriodicX, PeriodicY, PeriodicXY}
+
+// check if the given periodic mode is known
+func CheckPeriodic(mode string) error {
+	if !Contains(PeriodicModes, mode) {
+		return fmt.Errorf("unknown periodic mode %q, expected one of %v", mode, PeriodicModes)
+	}
+
+	return nil
+}
+
+// Return true if the map wraps around on the given side
+func Wraps(mode string, direction Direction) bool {
+	switch direction {
+	case East, West:
+		return mode == PeriodicX || mode == PeriodicXY
+	default:
+		return mode == PeriodicY || mode == PeriodicXY
+	}
+}
+
+// Move the point back into the map along the wrapping axes. Points
+// outside the map on other axes are returned as is.
+func (tilemap *Tilemap) Wrap(point Point) Point {
+	if Wraps(tilemap.Periodic, East) {
+		point.X = (point.X%tilemap.Width + tilemap.Width) % tilemap.Width
+	}
+
+	if Wraps(tilemap.Periodic, North) {
+		point.Y = (point.Y%tilemap.Height + tilemap.Height) % tilemap.Height
+	}
+
+	return point
+}
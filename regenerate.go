@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// parse a region of cells x,y,w,h
+func ParseRegion(spec string) (image.Rectangle, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("invalid region %q, expected x,y,width,height", spec)
+	}
+
+	values := make([]int, 4)
+	for i, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || value < 0 {
+			return image.Rectangle{}, fmt.Errorf("invalid region %q, expected x,y,width,height", spec)
+		}
+
+		values[i] = value
+	}
+
+	if values[2] == 0 || values[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("region %q is empty", spec)
+	}
+
+	return image.Rect(values[0], values[1], values[0]+values[2], values[1]+values[3]), nil
+}
+
+// Pin every tile of the given level, except the ones inside the region
+// (x,y,w,h) or the mask, so that only those are being generated anew
+func (wave *Wave) Inpaint(target, region, maskspec string) error {
+	var mask *Mask
+
+	// only the first tile layer of each tileset is being rewritten
+	if err := LDTKCheckTileLayers(wave.Project, target); err != nil {
+		return fmt.Errorf("can't regenerate level %s: %w", target, err)
+	}
+
+	if region != "" {
+		rect, err := ParseRegion(region)
+		if err != nil {
+			return err
+		}
+
+		mask = NewMask(wave.Width, wave.Height, wave.Width, wave.Height, func(x, y int) bool {
+			return image.Pt(x, y).In(rect)
+		})
+	} else {
+		var err error
+
+		mask, err = wave.LoadMask(maskspec)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := wave.PrepopulateExcept(target, mask); err != nil {
+		return err
+	}
+
+	// propagation alone may already decide the whole region, that's fine
+	for _, slot := range wave.OutputTilemap.Slotlist {
+		if mask.Used(slot.Position) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the region doesn't contain any cell of level %s", target)
+}
+
+// Write the regenerated level back into the project, into the level
+// itself or into a copy named identifier
+func (wave *Wave) ExportRegenerated(target, identifier string) error {
+	var err error
+
+	if identifier == "" || identifier == target {
+		err = LDTKUpdateLevel(wave.Project, target, &wave.OutputTilemap, wave.Cellsize)
+	} else {
+		err = LDTKAddLevel(wave.Project, target, identifier, &wave.OutputTilemap, wave.Cellsize)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return LDTKSaveProject(wave.Project)
+}
@@ -0,0 +1,39 @@
+package main
+
+import "fmt"
+
+// What to do if  a whole collapse attempt failed (the strategy gave
+// up).  Fixed just tries  again  with the same  budget, continuing
+// with the  same random  number  generator. Reseed  starts  every
+// attempt with a new  seed derived from the  original one, so that
+// each attempt  can be reproduced  on its own. Backoff  does the same
+// but doubles the retry budget with every attempt (starting at 1 if
+// it is 0).
+const (
+	RestartFixed   = "fixed"
+	RestartReseed  = "reseed"
+	RestartBackoff = "backoff"
+)
+
+var RestartModes = []string{RestartFixed, RestartReseed, RestartBackoff}
+
+// check if the given restart mode is known
+func CheckRestartMode(mode string) error {
+	if !Contains(RestartModes, mode) {
+		return fmt.Errorf("unknown restart mode %q, expected one of %v", mode, RestartModes)
+	}
+
+	return nil
+}
+
+// Derive the seed for the given attempt from the original seed, using
+// the splitmix64 mixer, so that seeds of consecutive attempts don't
+// correlate.
+func DeriveSeed(seed int64, attempt int) int64 {
+	mixed := uint64(seed) + uint64(attempt)*0x9e3779b97f4a7c15
+	mixed = (mixed ^ (mixed >> 30)) * 0xbf58476d1ce4e5b9
+	mixed = (mixed ^ (mixed >> 27)) * 0x94d049bb133111eb
+	mixed ^= mixed >> 31
+
+	return int64(mixed)
+}
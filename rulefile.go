@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Adjacency rules maintained by hand, in YAML or JSON. Tiles are referenced
+by their LDTK tile id or by their pixel position inside the tileset
+("x,y"). Sockets replace the constraints calculated from the tile
+edges, two tiles fit if the facing sockets are equal. Allow lists add
+explicit pairs on top of that, the adverse rule is implied. Rules only
+refer to the tiles as drawn, not to their rotated variants. E.g.:
+
+	tiles:
+	  - tile: 12
+	    sockets: {north: grass, east: road, south: grass, west: road}
+	    symmetry: I
+	  - tile: "32,16"
+	    sockets: {north: grass, east: grass, south: grass, west: grass}
+	    allow:
+	      east: [12, 13]
+*/
+type RuleFile struct {
+	Filename string     `yaml:"-"`
+	Tiles    []RuleTile `yaml:"tiles"`
+}
+
+type RuleTile struct {
+	Tile     any               `yaml:"tile"`
+	Sockets  map[string]string `yaml:"sockets"`
+	Allow    map[string][]any  `yaml:"allow"`
+	Symmetry string            `yaml:"symmetry"`
+}
+
+// names of the directions as used in rule files
+var DirectionNames = []string{"north", "east", "south", "west"}
+
+// load and parse a rule file, JSON is valid YAML, so both are supported
+func LoadRuleFile(filename string) (*RuleFile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule file %s: %w", filename, err)
+	}
+
+	rules := &RuleFile{Filename: filename}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(rules); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse rule file %s: %w", filename, err)
+	}
+
+	for _, rule := range rules.Tiles {
+		for name := range rule.Sockets {
+			if !Contains(DirectionNames, name) {
+				return nil, fmt.Errorf("rule file %s: tile %v: unknown direction %q in sockets",
+					filename, rule.Tile, name)
+			}
+		}
+
+		if rule.Sockets != nil && len(rule.Sockets) != 4 {
+			return nil, fmt.Errorf("rule file %s: tile %v: sockets for all 4 sides required",
+				filename, rule.Tile)
+		}
+
+		if rule.Symmetry != "" {
+			if err := CheckSymmetryClass(rule.Symmetry); err != nil {
+				return nil, fmt.Errorf("rule file %s: tile %v: %w", filename, rule.Tile, err)
+			}
+		}
+
+		for name := range rule.Allow {
+			if !Contains(DirectionNames, name) {
+				return nil, fmt.Errorf("rule file %s: tile %v: unknown direction %q in allow",
+					filename, rule.Tile, name)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// Return the tiles of the superposition the given reference points to,
+// either an LDTK tile id or a pixel position "x,y" inside the tileset
+func (rules *RuleFile) Resolve(ref any, superposition Superposition) ([]*Tile, error) {
+	var match func(tile *Tile) bool
+
+	switch value := ref.(type) {
+	case int:
+		match = func(tile *Tile) bool { return tile.TileId == value }
+	case string:
+		if x, y, found := strings.Cut(value, ","); found {
+			px, errx := strconv.Atoi(strings.TrimSpace(x))
+			py, erry := strconv.Atoi(strings.TrimSpace(y))
+			if errx != nil || erry != nil {
+				return nil, fmt.Errorf("rule file %s: invalid tile position %q, expected x,y",
+					rules.Filename, value)
+			}
+
+			match = func(tile *Tile) bool { return tile.Src == Point{X: px, Y: py} }
+		} else {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("rule file %s: invalid tile reference %q",
+					rules.Filename, value)
+			}
+
+			match = func(tile *Tile) bool { return tile.TileId == id }
+		}
+	default:
+		return nil, fmt.Errorf("rule file %s: invalid tile reference %v", rules.Filename, ref)
+	}
+
+	tiles := []*Tile{}
+
+	for _, tile := range superposition {
+		if tile.Transform == (Transform{}) && match(tile) {
+			tiles = append(tiles, tile)
+		}
+	}
+
+	if len(tiles) == 0 {
+		return nil, fmt.Errorf("rule file %s: unknown tile %v, it's not part of the example level",
+			rules.Filename, ref)
+	}
+
+	return tiles, nil
+}
+
+// Replace the constraints of the tiles  by the sockets of the rule
+// file. If sockets are being used at all, every tile needs them, either
+// from the rule file or from LDTK, see CheckSockets(). Also sets the
+// symmetry classes.
+func (rules *RuleFile) ApplySockets(superposition Superposition) error {
+	for _, rule := range rules.Tiles {
+		if rule.Sockets == nil && rule.Symmetry == "" {
+			continue
+		}
+
+		tiles, err := rules.Resolve(rule.Tile, superposition)
+		if err != nil {
+			return err
+		}
+
+		for _, tile := range tiles {
+			if rule.Symmetry != "" {
+				tile.Symmetry = rule.Symmetry
+			}
+
+			if rule.Sockets == nil {
+				continue
+			}
+
+			tile.Constraints = make([]string, 4)
+
+			for direction, name := range DirectionNames {
+				tile.Constraints[direction] = rule.Sockets[name]
+			}
+
+			tile.Sockets = true
+		}
+	}
+
+	return nil
+}
+
+// Add  the  allowed  pairs of the rule  file to the adjacency index. If
+// both tiles of a pair list the other one's direction, they must agree.
+func (rules *RuleFile) ApplyAllow(superposition Superposition, adjacency *Adjacency) error {
+	// all explicit rules, tile => direction => allowed tiles
+	explicit := map[*Tile]map[Direction]map[*Tile]bool{}
+
+	for _, rule := range rules.Tiles {
+		if rule.Allow == nil {
+			continue
+		}
+
+		tiles, err := rules.Resolve(rule.Tile, superposition)
+		if err != nil {
+			return err
+		}
+
+		for _, direction := range Directions {
+			refs, ok := rule.Allow[DirectionNames[direction]]
+			if !ok {
+				continue
+			}
+
+			// an empty list is explicit as well
+			for _, tile := range tiles {
+				if !Exists(explicit, tile) {
+					explicit[tile] = map[Direction]map[*Tile]bool{}
+				}
+
+				if !Exists(explicit[tile], direction) {
+					explicit[tile][direction] = map[*Tile]bool{}
+				}
+			}
+
+			for _, ref := range refs {
+				others, err := rules.Resolve(ref, superposition)
+				if err != nil {
+					return err
+				}
+
+				for _, tile := range tiles {
+					for _, other := range others {
+						explicit[tile][direction][other] = true
+					}
+				}
+			}
+		}
+	}
+
+	// check and apply in superposition order, so that errors are stable
+	for _, tile := range superposition {
+		for _, direction := range Directions {
+			adverse := GetAdverseDir(direction)
+
+			for _, other := range superposition {
+				if !explicit[tile][direction][other] {
+					continue
+				}
+
+				if Exists(explicit[other], adverse) && !explicit[other][adverse][tile] {
+					return fmt.Errorf("rule file %s: asymmetric rule, tile %d allows tile %d to the %s, but tile %d doesn't allow tile %d to the %s",
+						rules.Filename, tile.TileId, other.TileId, DirectionNames[direction],
+						other.TileId, tile.TileId, DirectionNames[adverse])
+				}
+
+				adjacency.Allow(tile.Index, direction, other.Index)
+			}
+		}
+	}
+
+	return nil
+}
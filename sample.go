@@ -0,0 +1,45 @@
+package main
+
+// The example level as a  grid of superposition indices, -1 marks an
+// empty cell. Used to learn patterns and neighbors from the level.
+type Sample struct {
+	Width, Height int
+	Cells         []int
+}
+
+// Return a new empty sample of the given size (in cells)
+func NewSample(width, height int) *Sample {
+	sample := &Sample{
+		Width:  width,
+		Height: height,
+		Cells:  make([]int, width*height),
+	}
+
+	for i := range sample.Cells {
+		sample.Cells[i] = -1
+	}
+
+	return sample
+}
+
+// Return the index of the tile at the given position, -1 if the cell
+// is empty or outside of the sample
+func (sample *Sample) At(x, y int) int {
+	if x < 0 || y < 0 || x >= sample.Width || y >= sample.Height {
+		return -1
+	}
+
+	return sample.Cells[y*sample.Width+x]
+}
+
+// Put the tile index at the given position, unless there's already a
+// tile
+func (sample *Sample) Place(x, y, index int) {
+	if x < 0 || y < 0 || x >= sample.Width || y >= sample.Height {
+		return
+	}
+
+	if sample.Cells[y*sample.Width+x] < 0 {
+		sample.Cells[y*sample.Width+x] = index
+	}
+}
@@ -1,15 +1,25 @@
 package main
 
-import (
-	"fmt"
-	"math/rand"
-)
+import "math/rand"
 
 // one spot in the target map,
 type Slot struct {
-	PossibleTiles         Superposition // starts with superposition
-	PreviousPossibleTiles Superposition // backup
+	PossibleTiles         Bitset        // indices into Superposition, starts with all
+	PreviousPossibleTiles Bitset        // backup
+	Superposition         Superposition // all tiles, shared by all slots
 	Position              Point
+	Priority              float64 // see Tilemap.NextSlot()
+	Epoch                 int     // last decision this slot has been saved for
+}
+
+// Return a new slot at the given position with all tiles possible
+func NewSlot(point Point, superposition Superposition) *Slot {
+	return &Slot{
+		PossibleTiles:         FullBitset(len(superposition)),
+		PreviousPossibleTiles: NewBitset(len(superposition)),
+		Superposition:         superposition,
+		Position:              point,
+	}
 }
 
 // Return true if slot is collapsed
@@ -24,72 +34,82 @@ func (slot *Slot) Broken() bool {
 
 // Tile count
 func (slot *Slot) Count() int {
-	return len(slot.PossibleTiles)
+	return slot.PossibleTiles.Count()
 }
 
 // return last tile, hopefully!
 func (slot *Slot) GetTile() *Tile {
-	return slot.PossibleTiles[0]
+	return slot.Superposition[slot.PossibleTiles.Next(0)]
 }
 
-func (slot *Slot) Collapse() {
-	tile := slot.PossibleTiles[rand.Intn(slot.Count())]
-	slot.PossibleTiles = Superposition{tile}
+// Return all tiles still possible in this slot
+func (slot *Slot) Possible() Superposition {
+	tiles := Superposition{}
+
+	for index := slot.PossibleTiles.Next(0); index >= 0; index = slot.PossibleTiles.Next(index + 1) {
+		tiles = append(tiles, slot.Superposition[index])
+	}
+
+	return tiles
 }
 
-func (slot *Slot) Copy() {
-	slot.PreviousPossibleTiles = slot.PossibleTiles
+// Reduce the slot to the tile with the given index
+func (slot *Slot) CollapseTo(index int) {
+	slot.PossibleTiles.Reset()
+	slot.PossibleTiles.Set(index)
 }
 
-func (slot *Slot) Backtrack() {
-	slot.PossibleTiles = slot.PreviousPossibleTiles
+// Pick one  of the  possible tiles  randomly and  reduce the slot to
+// it
+func (slot *Slot) Collapse(rng *rand.Rand) {
+	slot.CollapseTo(slot.Choose(rng))
 }
 
-/*
-Check  all tiles  on current  slot. If  the side  of a  tile pointing
-towards one of  the neighbor slot's tiles matching sides,  it will be
-kept. So we iterate over all current tiles and all neighbor tiles and
-look which ones adversial sides match.
-
-	 ----        ----
-	|    |  =>  |    |
-	 ----        ----
-
-slot.dir     other.adverse
-
-	east   =>  west
-*/
-func (slot *Slot) Exclude(otherslot *Slot, direction Direction) map[string]*Tile {
-	adversedirection := GetAdverseDir(direction)
-
-	keeptiles := map[string]*Tile{}
-
-	for _, othertile := range otherslot.PossibleTiles {
-		for _, tile := range slot.PossibleTiles {
-			if tile.Constraints[direction] == othertile.Constraints[adversedirection] {
-				if !Exists(keeptiles, tile.Id) {
-					if DEBUG {
-						fmt.Printf("        matching this dir %d %s <=> other dir %d %s\n",
-							direction, tile.Constraints[direction], adversedirection,
-							othertile.Constraints[adversedirection])
-					}
-
-					keeptiles[tile.Id] = tile
-				}
-			}
+// Pick one  of the  possible tiles  randomly, tiles  with a  higher
+// weight are being picked more often. Returns the tile index.
+func (slot *Slot) Choose(rng *rand.Rand) int {
+	possible := slot.PossibleTiles
+
+	total := 0.0
+	for index := possible.Next(0); index >= 0; index = possible.Next(index + 1) {
+		total += slot.Superposition[index].Weight
+	}
+
+	if total <= 0 {
+		// only weightless tiles left, treat them equally
+		return possible.Indices()[rng.Intn(slot.Count())]
+	}
+
+	pick := rng.Float64() * total
+	chosen := -1
+
+	for index := possible.Next(0); index >= 0; index = possible.Next(index + 1) {
+		chosen = index
+
+		pick -= slot.Superposition[index].Weight
+		if pick < 0 {
+			break
 		}
 	}
 
-	return keeptiles
+	return chosen
+}
+
+func (slot *Slot) Copy() {
+	slot.PreviousPossibleTiles.CopyFrom(slot.PossibleTiles)
+}
+
+func (slot *Slot) Backtrack() {
+	slot.PossibleTiles.CopyFrom(slot.PreviousPossibleTiles)
 }
 
 // Collapse    possible   tiles    on    this    slot   by    neighbor
 // constraints.  Neighbors  are  given  in the  slice  arg,  index  ==
-// direction, empty slice item means no neighbor in that direction
-func (slot *Slot) CollapseByConstraints(neighbors []*Slot) {
-	neighborcount := 0
-	tileregistry := map[string]*Tile{}
-	tilecounter := map[string]int{}
+// direction, empty slice item means no neighbor in that direction. A
+// tile is kept if every neighbor holds at least one tile which allows
+// it, according to the adjacency index. supported is temporary storage
+// of the size of the superposition.
+func (slot *Slot) CollapseByConstraints(neighbors []*Slot, adjacency *Adjacency, supported Bitset) {
 
 	// check all neighbor slots
 	for direction, otherslot := range neighbors {
@@ -97,30 +117,11 @@ func (slot *Slot) CollapseByConstraints(neighbors []*Slot) {
 			continue
 		}
 
-		// register how many neighbors there are
-		neighborcount++
+		// the neighbor  looks at us from  the adverse direction, so
+		// fetch all tiles its tiles allow on that side
+		adjacency.Supported(otherslot.PossibleTiles, GetAdverseDir(Direction(direction)), supported)
 
-		//  for  every registered  neighbor in  the given  direction
-		// fetch all tiles matching the neighbor constraint
-		tiles := slot.Exclude(otherslot, Direction(direction))
-
-		// count each matching tile
-		for id, tile := range tiles {
-			tileregistry[id] = tile
-			tilecounter[id]++
-		}
+		// only keep the tiles matching ALL neighbors
+		slot.PossibleTiles.And(supported)
 	}
-
-	newtiles := Superposition{}
-
-	// check  which tiles  are possible matches  on ALL  neighbors and
-	// register them
-	for id, count := range tilecounter {
-		if count == neighborcount {
-			newtiles = append(newtiles, tileregistry[id])
-		}
-	}
-
-	// set possible tiles to the new reduced tile slice
-	slot.PossibleTiles = newtiles
 }
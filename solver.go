@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Solver backends. Wfc is the randomized solver using the configured
+// heuristic and strategy, it may give up on solvable maps. Csp is an
+// exhaustive search, it either finds a solution or proves that there
+// is none, but may take forever on large maps.
+const (
+	SolverWFC = "wfc"
+	SolverCSP = "csp"
+)
+
+var Solvers = []string{SolverWFC, SolverCSP}
+
+// A Solver collapses all slots of the tilemap or returns why it can't
+type Solver interface {
+	Solve(ctx context.Context, tilemap *Tilemap) error
+}
+
+// check if the given solver is known
+func CheckSolver(solver string) error {
+	if !Contains(Solvers, solver) {
+		return fmt.Errorf("unknown solver %q, expected one of %v", solver, Solvers)
+	}
+
+	return nil
+}
+
+// Return the solver backend with the given name
+func NewSolver(name string, retries int) Solver {
+	if name == SolverCSP {
+		return &CSPSolver{}
+	}
+
+	return &WFCSolver{Retries: retries}
+}
+
+// The randomized solver, see Tilemap.Collapse()
+type WFCSolver struct {
+	Retries int // budget of the strategy
+}
+
+func (solver *WFCSolver) Solve(ctx context.Context, tilemap *Tilemap) error {
+	return tilemap.Collapse(ctx, solver.Retries)
+}
+
+// Returned by the callback of CSPSolver.Enumerate() to stop searching,
+// the tilemap keeps the current solution
+var errStopSearch = errors.New("stop search")
+
+/*
+Complete backtracking search with arc consistency. Before the search
+and after each decision the constraints are propagated (AC-3 on the
+slot grid, see Tilemap.PropagateFrom()). The slot with the fewest
+possible tiles is decided next, its tiles are tried in random order.
+If all tiles of a slot fail, the search backs up to the previous
+decision. Only if every combination has been ruled out, the map has no
+solution.
+*/
+type CSPSolver struct{}
+
+// Find one solution, the tilemap is left collapsed
+func (solver *CSPSolver) Solve(ctx context.Context, tilemap *Tilemap) error {
+	count, err := solver.Enumerate(ctx, tilemap, 1, nil)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return fmt.Errorf("%w: no solution exists for %dx%d slots",
+			ErrUnsatisfiable, tilemap.Width, tilemap.Height)
+	}
+
+	if !tilemap.Quiet {
+		fmt.Printf("Collapsed: %t, Broken: %t\n", tilemap.Collapsed(), tilemap.Broken())
+	}
+
+	return nil
+}
+
+// Search  up  to  limit  solutions (0 means all of them) and call
+// found with each one, while the tilemap holds it. Returns the number
+// of solutions found. If the limit is reached, the tilemap keeps the
+// last solution, otherwise it is restored.
+func (solver *CSPSolver) Enumerate(ctx context.Context, tilemap *Tilemap, limit int,
+	found func(solution int) error) (int, error) {
+	count := 0
+	initial := tilemap.Snapshot()
+
+	start := time.Now()
+	defer func() {
+		tilemap.Stats.RoundsDuration = append(tilemap.Stats.RoundsDuration, time.Since(start))
+	}()
+
+	if err := tilemap.Propagate(); err != nil {
+		tilemap.Restore(initial)
+		return 0, nil
+	}
+
+	err := solver.search(ctx, tilemap, func() error {
+		count++
+
+		if found != nil {
+			if err := found(count); err != nil {
+				return err
+			}
+		}
+
+		if count == limit {
+			return errStopSearch
+		}
+
+		return nil
+	})
+
+	switch {
+	case errors.Is(err, errStopSearch):
+		return count, nil
+	case err != nil:
+		return count, err
+	}
+
+	tilemap.Restore(initial)
+
+	return count, nil
+}
+
+// Decide the next slot, recurse, undo. Returns errStopSearch to unwind
+// without restoring anything.
+func (solver *CSPSolver) search(ctx context.Context, tilemap *Tilemap, found func() error) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("search cancelled: %w", err)
+	}
+
+	// the most constrained slot first
+	var next *Slot
+	for _, slot := range tilemap.Slotlist {
+		if !slot.Collapsed() && (next == nil || slot.Count() < next.Count()) {
+			next = slot
+		}
+	}
+
+	if next == nil {
+		return found()
+	}
+
+	snapshot := tilemap.Snapshot()
+	candidates := next.PossibleTiles.Indices()
+
+	if tilemap.Rand != nil {
+		tilemap.Rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+	}
+
+	for _, tile := range candidates {
+		next.CollapseTo(tile)
+		tilemap.Remember(next, tile, false)
+		tilemap.Stats.Rounds++
+
+		if tilemap.PropagateFrom(next) == nil {
+			if err := solver.search(ctx, tilemap, found); err != nil {
+				return err
+			}
+		}
+
+		tilemap.Restore(snapshot)
+		tilemap.Stats.Backtracked++
+	}
+
+	return nil
+}
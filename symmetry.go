@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"slices"
+	"strings"
+)
+
+// Which rotated and reflected variants of the tiles to generate
+const (
+	VariantsNone   = "none"   // only the tiles as drawn
+	VariantsTagged = "tagged" // tiles with a symmetry class
+	VariantsAuto   = "auto"   // every distinct variant of every tile
+)
+
+var VariantModes = []string{VariantsNone, VariantsTagged, VariantsAuto}
+
+// A variant of a tile: mirrored horizontally (first), then rotated
+// clockwise by Rotation quarter turns
+type Transform struct {
+	Rotation int
+	Flip     bool
+}
+
+/*
+The symmetry classes  of the classic simple tiled model, named  after the
+letters they look like. Each class lists the variants which look
+different from each other:
+
+	X  symmetric in every direction, e.g. plain grass
+	I  2 variants, e.g. a straight road
+	\  2 variants, e.g. a diagonal
+	T  4 variants, e.g. a junction
+	L  4 variants, e.g. a corner
+	F  8 variants, no symmetry at all
+*/
+var SymmetryClasses = map[string][]Transform{
+	"X":  {{0, false}},
+	"I":  {{0, false}, {1, false}},
+	"\\": {{0, false}, {1, false}},
+	"T":  {{0, false}, {1, false}, {2, false}, {3, false}},
+	"L":  {{0, false}, {1, false}, {2, false}, {3, false}},
+	"F": {{0, false}, {1, false}, {2, false}, {3, false},
+		{0, true}, {1, true}, {2, true}, {3, true}},
+}
+
+// check if the given symmetry class is known
+func CheckSymmetryClass(class string) error {
+	if !Exists(SymmetryClasses, strings.ToUpper(class)) {
+		return fmt.Errorf("unknown symmetry class %q, expected one of X, I, \\, T, L or F", class)
+	}
+
+	return nil
+}
+
+// The variants LDTK is able to represent using flip bits
+var LDTKTransforms = []Transform{{0, false}, {0, true}, {2, true}, {2, false}}
+
+// Small patterns having exactly the symmetry of each class, two variants
+// of a class look alike if they look alike on its pattern
+var symmetryPatterns = map[string][]string{
+	"X":  {"#.#", ".#.", "#.#"},
+	"I":  {".#.", ".#.", ".#."},
+	"\\": {"#..", ".#.", "..#"},
+	"T":  {"###", ".#.", "..."},
+	"L":  {".#.", ".##", "..."},
+	"F":  {"##.", "#..", "#.."},
+}
+
+// Render the pattern of the class transformed
+func symmetryPattern(class string, transform Transform) []uint8 {
+	rows := symmetryPatterns[class]
+	pattern := image.NewGray(image.Rect(0, 0, len(rows), len(rows)))
+
+	for y, row := range rows {
+		for x, cell := range row {
+			if cell == '#' {
+				pattern.Pix[y*pattern.Stride+x] = 255
+			}
+		}
+	}
+
+	return transform.Image(pattern).(*image.RGBA).Pix
+}
+
+// Return the  variants of  the given class. If flipsonly is set, each
+// variant is replaced by one LDTK is able to represent using flip bits,
+// which looks the same. Variants without such a twin are left out, e.g.
+// the vertical variant of I.
+func SymmetryTransforms(class string, flipsonly bool) []Transform {
+	class = strings.ToUpper(class)
+
+	if !flipsonly {
+		return SymmetryClasses[class]
+	}
+
+	transforms := []Transform{}
+
+	for _, variant := range SymmetryClasses[class] {
+		looks := symmetryPattern(class, variant)
+
+		for _, transform := range LDTKTransforms {
+			if slices.Equal(looks, symmetryPattern(class, transform)) {
+				transforms = append(transforms, transform)
+				break
+			}
+		}
+	}
+
+	return transforms
+}
+
+// Apply the transform to the given (square) tile image
+func (transform Transform) Image(img image.Image) image.Image {
+	bounds := img.Bounds()
+	size := bounds.Dx()
+	transformed := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			tx, ty := x, y
+
+			if transform.Flip {
+				tx = size - 1 - tx
+			}
+
+			for i := 0; i < transform.Rotation; i++ {
+				tx, ty = size-1-ty, tx
+			}
+
+			transformed.Set(tx, ty, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return transformed
+}
+
+// Apply the transform to the given  sockets (one per direction). The
+// sockets themselves are expected to be symmetric.
+func (transform Transform) Sockets(sockets []string) []string {
+	transformed := append([]string{}, sockets...)
+
+	if transform.Flip {
+		transformed[East], transformed[West] = transformed[West], transformed[East]
+	}
+
+	rotated := make([]string, 4)
+	for _, direction := range Directions {
+		// turning clockwise, the west side becomes the north side etc
+		rotated[direction] = transformed[(int(direction)-transform.Rotation+4)%4]
+	}
+
+	return rotated
+}
+
+// Return the LDTK flip bits (1 = X, 2 = Y) for the transform. LDTK is
+// not able to rotate tiles, so quarter turns can't be represented.
+func (transform Transform) LDTKFlip() (byte, error) {
+	switch {
+	case transform.Rotation == 0 && !transform.Flip:
+		return 0, nil
+	case transform.Rotation == 0 && transform.Flip:
+		return 1, nil
+	case transform.Rotation == 2 && transform.Flip:
+		return 2, nil
+	case transform.Rotation == 2 && !transform.Flip:
+		return 3, nil
+	}
+
+	return 0, fmt.Errorf("tile rotated by %d degrees can't be represented in LDTK",
+		transform.Rotation*90)
+}
+
+// The reverse of the above, the transform matching the given flip bits
+func TransformFromLDTKFlip(flip byte) Transform {
+	switch flip & 3 {
+	case 1:
+		return Transform{0, true}
+	case 2:
+		return Transform{2, true}
+	case 3:
+		return Transform{2, false}
+	}
+
+	return Transform{}
+}
+
+// Return a new tile which is the given variant of the tile, the edge
+// constraints are calculated from the transformed image, sockets are
+// turned along with the tile.
+func (tile *Tile) Variant(transform Transform, matcher *EdgeMatcher) (*Tile, error) {
+	variant := *tile
+	variant.Transform = transform
+	variant.Image = transform.Image(tile.Image)
+
+	id, err := GetImageHash(variant.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	variant.Id = id
+	variant.Constraints = make([]string, 4)
+
+	if tile.Sockets {
+		variant.Constraints = transform.Sockets(tile.Constraints)
+	} else {
+		for i, direction := range Directions {
+			variant.Constraints[i] = matcher.Constraint(variant.Image, direction)
+		}
+	}
+
+	return &variant, nil
+}
+
+// Add the rotated and reflected variants of the tiles according to the
+// given mode. Variants looking exactly like an existing tile are not
+// added.
+func AddVariants(superposition Superposition, mode string, flipsonly bool, matcher *EdgeMatcher) (Superposition, error) {
+	registry := map[string]bool{}
+
+	key := func(tile *Tile) string {
+		return tile.Id + strings.Join(tile.Constraints, "")
+	}
+
+	for _, tile := range superposition {
+		registry[key(tile)] = true
+	}
+
+	variants := Superposition{}
+
+	for _, tile := range superposition {
+		var transforms []Transform
+
+		switch {
+		case mode == VariantsNone:
+			continue
+		case tile.Symmetry != "":
+			transforms = SymmetryTransforms(tile.Symmetry, flipsonly)
+		case mode == VariantsAuto:
+			transforms = SymmetryTransforms("F", flipsonly)
+		}
+
+		for _, transform := range transforms {
+			if transform == (Transform{}) {
+				continue
+			}
+
+			variant, err := tile.Variant(transform, matcher)
+			if err != nil {
+				return nil, err
+			}
+
+			if registry[key(variant)] {
+				continue
+			}
+
+			registry[key(variant)] = true
+			variants = append(variants, variant)
+		}
+	}
+
+	return append(superposition, variants...), nil
+}
@@ -9,13 +9,23 @@ type Tile struct {
 	Id          string
 	Type        string
 	Image       image.Image
-	Constraints []string // one per side
+	Constraints []string  // one per side
+	TileId      int       // LDTK tile id inside the tileset
+	TilesetUid  int       // LDTK uid of the tileset the tile comes from
+	Src         Point     // pixel position of the tile inside the tileset
+	Weight      float64   // relative probability of the tile being chosen
+	Index       int       // position inside the superposition
+	Pattern     Pattern   // overlap model: the tiles of the pattern, see overlap.go
+	Sockets     bool      // constraints are sockets maintained by hand, not pixel edges
+	Tags        []string  // enum values assigned in LDTK
+	Symmetry    string    // symmetry class, see symmetry.go
+	Transform   Transform // variant of the tile as drawn in the tileset
 }
 
 type Superposition []*Tile
 
-func NewTile(img image.Image, checkpoints int) (*Tile, error) {
-	tile := &Tile{Image: img}
+func NewTile(img image.Image, matcher *EdgeMatcher) (*Tile, error) {
+	tile := &Tile{Image: img, Weight: 1}
 	tile.Constraints = make([]string, 4)
 
 	id, err := GetImageHash(img)
@@ -26,18 +36,59 @@ func NewTile(img image.Image, checkpoints int) (*Tile, error) {
 	tile.Id = id
 
 	for i, direction := range Directions {
-		tile.Constraints[i] = GetConstraint(img, direction, checkpoints)
+		tile.Constraints[i] = matcher.Constraint(img, direction)
 	}
 
 	return tile, nil
 }
 
+// Sockets and pixel edges never match, so if sockets are being used,
+// every tile needs them
+func CheckSockets(superposition Superposition) error {
+	count := 0
+
+	for _, tile := range superposition {
+		if tile.Sockets {
+			count++
+		}
+	}
+
+	if count == 0 || count == len(superposition) {
+		return nil
+	}
+
+	for _, tile := range superposition {
+		if !tile.Sockets {
+			return fmt.Errorf("tile %d at %d,%d has no sockets", tile.TileId, tile.Src.X, tile.Src.Y)
+		}
+	}
+
+	return nil
+}
+
 func (tile *Tile) Dump() string {
-	return fmt.Sprintf("  [N:%s E:%s S:%s W:%s <%s>]",
+	if tile.Pattern != nil {
+		return fmt.Sprintf("  [pattern:%v <%s> %d:%g]",
+			tile.Pattern,
+			tile.Id,
+			tile.TileId,
+			tile.Weight,
+		)
+	}
+
+	tags := ""
+	if tile.Type != "" {
+		tags = fmt.Sprintf(" type:%s tags:%v", tile.Type, tile.Tags)
+	}
+
+	return fmt.Sprintf("  [N:%s E:%s S:%s W:%s <%s> %d:%g%s]",
 		tile.Constraints[North],
 		tile.Constraints[East],
 		tile.Constraints[South],
 		tile.Constraints[West],
 		tile.Id,
+		tile.TileId,
+		tile.Weight,
+		tags,
 	)
 }
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"sort"
+	"math/rand"
 	"time"
 )
 
 type Stats struct {
+	Seed                                int64
 	Superpositions, Backtracked, Rounds int
+	Propagations                        int // number of slots revisited
+	Attempts                            int // number of collapse attempts
 	Duration                            time.Duration
 	RoundsDuration                      []time.Duration
 }
@@ -23,16 +27,33 @@ type Tilemap struct {
 	Slotlist      []*Slot // same content, but used for iterating or sorting
 	Copylist      []*Slot
 	Collapsing    bool
+	Heuristic     string      // how to pick the next slot to collapse
+	Rand          *rand.Rand  // shared with the wave, see Wave.SetSeed()
+	Adjacency     *Adjacency  // shared with the wave, see Wave.SetupAdjacency()
+	Strategy      string      // what to do on contradictions, see backtrack.go
+	Decisions     []Decision  // decision stack, see backtrack.go
+	Trail         []Undo      // undo records of all decisions on the stack
+	Epoch         int         // incremented with every decision
+	Scratch       Bitset      // temporary storage used during propagation
+	Supported     Bitset      // same, see Slot.CollapseByConstraints()
+	Neighbors     [2][4]*Slot // same, neighbors of the revisited slots
+	Quiet         bool        // don't print progress
+	Periodic      string      // wrapping axes, see periodic.go
+	Mask          *Mask       // cells to generate, nil means all, see mask.go
+	History       []Step      // the last steps, see contradiction.go
 	Stats         Stats
 }
 
 // Return a new empty Tilemap
 func NewTilemap(width, height int) Tilemap {
 	return Tilemap{
-		Width:    width,
-		Height:   height,
-		Slots:    make(map[Point]*Slot, width*height),
-		Slotlist: make([]*Slot, width*height),
+		Width:     width,
+		Height:    height,
+		Slots:     make(map[Point]*Slot, width*height),
+		Slotlist:  make([]*Slot, 0, width*height),
+		Heuristic: HeuristicEntropy,
+		Strategy:  StrategyBacktrack,
+		Periodic:  PeriodicNone,
 	}
 }
 
@@ -41,30 +62,65 @@ func NewTilemap(width, height int) Tilemap {
 // reduced ("collapsed") up to the point where only 1 tile is left. At
 // that point it is considered to be in collapsed state.
 func (tilemap *Tilemap) Populate(superposition Superposition) {
-	pos := 0
+	tilemap.Slots = make(map[Point]*Slot, tilemap.Width*tilemap.Height)
+	tilemap.Slotlist = tilemap.Slotlist[:0]
 
 	for y := 0; y < tilemap.Height; y++ {
 		for x := 0; x < tilemap.Width; x++ {
 			point := Point{X: x, Y: y}
-			tilemap.Slots[point] = &Slot{PossibleTiles: superposition, Position: point}
-			tilemap.Slotlist[pos] = tilemap.Slots[point]
-			pos++
+
+			// masked cells don't get a slot at all
+			if tilemap.Mask != nil && !tilemap.Mask.Used(point) {
+				continue
+			}
+
+			tilemap.Slots[point] = NewSlot(point, superposition)
+			tilemap.Slotlist = append(tilemap.Slotlist, tilemap.Slots[point])
 		}
 	}
 
+	tilemap.Scratch = NewBitset(len(superposition))
+	tilemap.Supported = NewBitset(len(superposition))
+
 	tilemap.Stats.Superpositions = len(superposition)
 }
 
+// A copy of the possible tiles of all slots, in Slotlist order. All
+// bitsets are stored in one flat slice, so taking a snapshot is just
+// one allocation and a couple of copies.
+type Snapshot []uint64
+
+// Take a snapshot of the current possibility space
+func (tilemap *Tilemap) Snapshot() Snapshot {
+	snapshot := make(Snapshot, 0, len(tilemap.Slotlist)*len(tilemap.Scratch))
+
+	for _, slot := range tilemap.Slotlist {
+		snapshot = append(snapshot, slot.PossibleTiles...)
+	}
+
+	return snapshot
+}
+
+// Restore the possibility space from the given snapshot
+func (tilemap *Tilemap) Restore(snapshot Snapshot) {
+	offset := 0
+
+	for _, slot := range tilemap.Slotlist {
+		copy(slot.PossibleTiles, snapshot[offset:offset+len(slot.PossibleTiles)])
+		offset += len(slot.PossibleTiles)
+	}
+}
+
 // Make a copy of the current possibility space for backtracking
 func (tilemap *Tilemap) Copy() {
-	for _, slot := range tilemap.Slots {
+	for _, slot := range tilemap.Slotlist {
 		slot.Copy()
 	}
 }
 
 // Restore previous tile set, thus backtrack one step
 func (tilemap *Tilemap) Backtrack() {
-	for _, slot := range tilemap.Slots {
+	for _, slot := range tilemap.Slotlist {
 		slot.Backtrack()
 	}
 
@@ -86,10 +142,15 @@ func (tilemap *Tilemap) DumpData(full bool) {
 	for y := 0; y < tilemap.Height; y++ {
 		for x := 0; x < tilemap.Width; x++ {
 			point := Point{X: x, Y: y}
+			if !Exists(tilemap.Slots, point) {
+				fmt.Printf("(%v):-", point)
+				continue
+			}
+
 			fmt.Printf("(%v):%d", point, tilemap.Slots[point].Count())
 			if full {
 				fmt.Println()
-				for _, tile := range tilemap.Slots[point].PossibleTiles {
+				for _, tile := range tilemap.Slots[point].Possible() {
 					fmt.Println(tile.Dump())
 				}
 			}
@@ -101,7 +162,7 @@ func (tilemap *Tilemap) DumpData(full bool) {
 // Return true if  all slots are collapsed, that is  - each slots only
 // contains 1 tile
 func (tilemap *Tilemap) Collapsed() bool {
-	for _, slot := range tilemap.Slots {
+	for _, slot := range tilemap.Slotlist {
 		if !slot.Collapsed() {
 			return false
 		}
@@ -112,7 +173,7 @@ func (tilemap *Tilemap) Collapsed() bool {
 
 // Return true if at least 1 slot doesn't contain a tile anymore
 func (tilemap *Tilemap) Broken() bool {
-	for _, slot := range tilemap.Slots {
+	for _, slot := range tilemap.Slotlist {
 		if slot.Broken() {
 			return true
 		}
@@ -122,16 +183,17 @@ func (tilemap *Tilemap) Broken() bool {
 }
 
 // Return  true  if  the  given  slot has  a  neighbor  in  the  given
-// direction. If there's a map edge on that side, returns false.
+// direction. If there's a map edge on that side, returns false, unless
+// the map wraps around on that axis.
 func (tilemap *Tilemap) SlotHasNeighbor(slot *Slot, direction Direction) bool {
-	point := slot.Position.MoveDirection(direction)
+	point := tilemap.Wrap(slot.Position.MoveDirection(direction))
 	//fmt.Printf("        %v => %d => %v\n", slot.Position, direction, point)
 	return Exists(tilemap.Slots, point)
 }
 
 // Returns neighbor slot to the given direction, if any
 func (tilemap *Tilemap) GetSlotNeighbor(slot *Slot, direction Direction) (*Slot, error) {
-	point := slot.Position.MoveDirection(direction)
+	point := tilemap.Wrap(slot.Position.MoveDirection(direction))
 
 	if !Exists(tilemap.Slots, point) {
 		return nil, fmt.Errorf("no slot at position %v", point)
@@ -143,101 +205,238 @@ func (tilemap *Tilemap) GetSlotNeighbor(slot *Slot, direction Direction) (*Slot,
 	return tilemap.Slots[point], nil
 }
 
-// Sort helper, sort Slot slice by tile count, lowest count goes first
-func (tilemap *Tilemap) Sort() {
-	sort.Slice(tilemap.Slotlist, func(left, right int) bool {
-		return tilemap.Slotlist[left].Count() < tilemap.Slotlist[right].Count()
-	})
-}
-
-// Try to collapse all slots, recursively
-func (tilemap *Tilemap) Collapse(retries int) error {
-	tries := 0
+// Returns  all neighbors of the  given slot, index ==  direction, nil
+// means no neighbor in that direction
+func (tilemap *Tilemap) GetSlotNeighbors(slot *Slot) ([]*Slot, error) {
+	neighbors := [4]*Slot{}
 
-	for !tilemap.Collapsed() {
-		start := time.Now()
+	if err := tilemap.FillSlotNeighbors(slot, &neighbors); err != nil {
+		return nil, err
+	}
 
-		//  make a  backup of  the current  state of  the tilemap.  If
-		//  collapsing   fails,  we  can   restore  it  and   thus  do
-		// backtracking.
-		tilemap.Copy()
+	return neighbors[:], nil
+}
 
-		// we sort the slots by tile count, that way the slot with the
-		// lowest entropy  goes first, which we collapse  at the start
-		// of every loop run.
-		tilemap.Sort()
+// Same, but fill the given buffer, so nothing is allocated
+func (tilemap *Tilemap) FillSlotNeighbors(slot *Slot, neighbors *[4]*Slot) error {
+	for _, direction := range Directions {
+		neighbors[direction] = nil
 
-		// only collapse 1 slot per run
-		collapsing := false
+		if DEBUG {
+			fmt.Printf("    looking into direction %d\n", direction)
+		}
 
-		for _, slot := range tilemap.Slotlist {
-			point := slot.Position
+		if !tilemap.SlotHasNeighbor(slot, direction) {
 			if DEBUG {
-				fmt.Printf("looking at slot at point %v\n", point)
+				fmt.Printf("       slot has no neighbor in direction %d\n", direction)
 			}
+			continue
+		}
 
-			if slot.Collapsed() {
-				// already collapsed, ignore this time
-				if DEBUG {
-					fmt.Println("    ignore already collapsed")
-				}
+		neighborslot, err := tilemap.GetSlotNeighbor(slot, direction)
+		if err != nil {
+			return err
+		}
+
+		neighbors[direction] = neighborslot
+	}
+
+	return nil
+}
+
+// Pin the slot at the  given point to the given tile. Every tile of
+// the slot with the same id will be kept, all others are removed.
+func (tilemap *Tilemap) Pin(point Point, tile *Tile) error {
+	if !Exists(tilemap.Slots, point) {
+		return fmt.Errorf("no slot at position %v", point)
+	}
+
+	slot := tilemap.Slots[point]
+	pinned := NewBitset(len(slot.Superposition))
+
+	for _, possible := range slot.Possible() {
+		if possible.Id == tile.Id {
+			pinned.Set(possible.Index)
+		}
+	}
+
+	if pinned.Count() == 0 {
+		return fmt.Errorf("tile %d at position %v is not part of the superposition",
+			tile.TileId, point)
+	}
+
+	slot.PossibleTiles.CopyFrom(pinned)
+
+	return nil
+}
+
+// Reduce all slots by the constraints of their neighbors until nothing
+// changes  anymore. Used to  propagate the constraints  of pre-populated
+// slots to the rest of the map.
+func (tilemap *Tilemap) Propagate() error {
+	return tilemap.PropagateFrom(tilemap.Slotlist...)
+}
+
+// Propagate the constraints of the  given (changed) slots to the rest
+// of the map. Only the neighbors of a changed slot are revisited, if
+// one of them changes too, its neighbors are  put onto the worklist
+// as well and so on, until nothing changes anymore.
+func (tilemap *Tilemap) PropagateFrom(changed ...*Slot) error {
+	worklist := make([]*Slot, 0, len(changed))
+	queued := make(map[Point]bool, len(changed))
+
+	for _, slot := range changed {
+		worklist = append(worklist, slot)
+		queued[slot.Position] = true
+	}
+
+	for len(worklist) > 0 {
+		current := worklist[0]
+		worklist = worklist[1:]
+		queued[current.Position] = false
+
+		neighbors := &tilemap.Neighbors[0]
+		if err := tilemap.FillSlotNeighbors(current, neighbors); err != nil {
+			return err
+		}
+
+		for _, slot := range neighbors {
+			if slot == nil {
 				continue
 			}
 
-			if !collapsing {
-				// first slot for this round, collapse  this one
-				if DEBUG {
-					fmt.Println("    collapsing first")
-				}
-				slot.Collapse()
-				collapsing = true
-				continue
+			if DEBUG {
+				fmt.Printf("    revisiting slot at point %v\n", slot.Position)
 			}
 
-			neighbors := make([]*Slot, 4)
+			// for the neighbor, look at each direction and exclude any
+			// tile which does not match one of the tiles of its own
+			// neighbor slots.
+			slotneighbors := &tilemap.Neighbors[1]
+			if err := tilemap.FillSlotNeighbors(slot, slotneighbors); err != nil {
+				return err
+			}
 
-			// for  current slot, look  at each direction  and exclude
-			//  any  tile  which  does  not match  one  of  the  tiles
-			// of the neighbor slot.
-			for _, direction := range Directions {
-				if DEBUG {
-					fmt.Printf("    looking into direction %d\n", direction)
-				}
-				if !tilemap.SlotHasNeighbor(slot, direction) {
-					if DEBUG {
-						fmt.Printf("       slot has no neighbor in direction %d\n", direction)
-					}
-					continue
+			tilemap.Scratch.CopyFrom(slot.PossibleTiles)
+			slot.CollapseByConstraints(slotneighbors[:], tilemap.Adjacency, tilemap.Supported)
+			tilemap.Stats.Propagations++
+
+			if !slot.PossibleTiles.Equal(tilemap.Scratch) {
+				// remember the previous state for backtracking
+				tilemap.Save(slot, tilemap.Scratch)
+				slot.Priority = tilemap.Priority(slot)
+
+				if slot.Broken() {
+					return fmt.Errorf("slot at position %v has no possible tile left", slot.Position)
 				}
 
-				neighborslot, err := tilemap.GetSlotNeighbor(slot, direction)
-				if err != nil {
-					return err
+				if !queued[slot.Position] {
+					worklist = append(worklist, slot)
+					queued[slot.Position] = true
 				}
+			}
+		}
+	}
 
-				neighbors[direction] = neighborslot
+	return nil
+}
 
-			}
-			slot.CollapseByConstraints(neighbors)
+// (Re-)calculate the priorities of all slots, see Tilemap.Priority()
+func (tilemap *Tilemap) Prioritize() {
+	for _, slot := range tilemap.Slotlist {
+		slot.Priority = tilemap.Priority(slot)
+	}
+}
+
+// Returns the uncollapsed slot with the lowest priority, that is the
+// one the heuristic wants to collapse next, nil if there is none
+func (tilemap *Tilemap) NextSlot() *Slot {
+	var next *Slot
+
+	for _, slot := range tilemap.Slotlist {
+		if slot.Collapsed() || slot.Broken() {
+			continue
+		}
+
+		if next == nil || slot.Priority < next.Priority {
+			next = slot
+		}
+	}
+
+	return next
+}
+
+// Try to collapse all slots using the configured strategy
+func (tilemap *Tilemap) Collapse(ctx context.Context, retries int) error {
+	switch tilemap.Strategy {
+	case StrategyRestart:
+		return tilemap.CollapseRestart(ctx, retries)
+	default:
+		return tilemap.CollapseBacktrack(ctx, retries)
+	}
+}
+
+// Try to collapse all  slots, one per round. If  that fails, restore
+// the state before the  round and try again, at most retries times.
+func (tilemap *Tilemap) CollapseRestart(ctx context.Context, retries int) error {
+	tries := 0
+
+	tilemap.History = nil
+	tilemap.Prioritize()
+
+	for !tilemap.Collapsed() {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("collapse cancelled: %w", err)
+		}
+
+		start := time.Now()
+
+		//  make a  backup of  the current  state of  the tilemap.  If
+		//  collapsing   fails,  we  can   restore  it  and   thus  do
+		// backtracking.
+		tilemap.Copy()
+
+		// the heuristic (by default entropy) decides which slot goes
+		// first, that way the slot with the lowest entropy is the one
+		// we collapse in this round.
+		slot := tilemap.NextSlot()
+		if slot == nil {
+			return errors.New("no collapsible slot left")
+		}
+
+		if DEBUG {
+			fmt.Printf("collapsing slot at point %v\n", slot.Position)
 		}
 
+		tile := slot.Choose(tilemap.Rand)
+		slot.CollapseTo(tile)
+		tilemap.Remember(slot, tile, false)
+
+		// then only revisit the slots affected by this decision
+		err := tilemap.PropagateFrom(slot)
+
 		if DEBUG {
 			fmt.Println()
 		}
 
-		if tilemap.Broken() {
+		if err != nil {
+			if DEBUG {
+				fmt.Println(err)
+			}
+
 			if tries < retries {
 				if DEBUG {
 					fmt.Println("BACKTRACKING")
 				}
 				tilemap.Backtrack()
+				tilemap.Prioritize()
 
 				//tilemap.Printstats()
 				fmt.Printf("tries: %d, retries: %d\n", tries, retries)
 				tries++
 			} else {
 				fmt.Printf("error tries: %d, retries: %d\n", tries, retries)
-				return errors.New("tilemap broken too many times")
+				return tilemap.Contradiction(errors.New("tilemap broken too many times"))
 			}
 		}
 
@@ -247,7 +446,9 @@ func (tilemap *Tilemap) Collapse(retries int) error {
 
 	}
 
-	fmt.Printf("Collapsed: %t, Broken: %t\n", tilemap.Collapsed(), tilemap.Broken())
+	if !tilemap.Quiet {
+		fmt.Printf("Collapsed: %t, Broken: %t\n", tilemap.Collapsed(), tilemap.Broken())
+	}
 
 	return nil
 }
@@ -257,9 +458,12 @@ func (tilemap *Tilemap) Printstats() {
 		tilemap.Stats.Duration += dur
 	}
 
+	fmt.Printf("          Seed: %d\n", tilemap.Stats.Seed)
 	fmt.Printf("Superpositions: %d\n", tilemap.Stats.Superpositions)
 	fmt.Printf("         Slots: %d\n", len(tilemap.Slots))
 	fmt.Printf("        Rounds: %d\n", tilemap.Stats.Rounds)
+	fmt.Printf("      Attempts: %d\n", tilemap.Stats.Attempts)
 	fmt.Printf("   Backtracked: %d\n", tilemap.Stats.Backtracked)
+	fmt.Printf("  Propagations: %d\n", tilemap.Stats.Propagations)
 	fmt.Printf("    time taken: %s\n", tilemap.Stats.Duration)
 }
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"math/rand"
+	"time"
 )
 
 var DEBUG bool
@@ -12,7 +16,25 @@ var DEBUG bool
 type Wave struct {
 	OutputTilemap                        Tilemap
 	Width, Height, Cellsize, Checkpoints int
-	Superposition                        Superposition // holds all possible tiles
+	Superposition                        Superposition       // holds all possible tiles
+	Project                              *LDTKProject        // only set if loaded from LDTK
+	Level                                string              // LDTK level used as example
+	Seedlevel                            string              // LDTK level to pre-populate from, if any
+	Sample                               *Sample             // the example level as grid
+	Model                                Model               // how to learn from the example, see overlap.go
+	RuleFile                             *RuleFile           // hand made rules, if any
+	Heuristic                            string              // slot selection, see heuristic.go
+	Strategy                             string              // contradiction handling, see backtrack.go
+	Solver                               string              // solver backend, see solver.go
+	Periodic                             string              // wrapping axes, see periodic.go
+	Retries                              int                 // budget of the strategy per attempt
+	Restarts                             int                 // how often to start over if an attempt fails
+	RestartMode                          string              // how to start over, see restart.go
+	Timeout                              time.Duration       // give up after this, 0 means no limit
+	Seed                                 int64               // seed of Rand, printed with the stats
+	Rand                                 *rand.Rand          // used for every random decision
+	Adjacency                            *Adjacency          // which tiles may be placed next to each other
+	Contradiction                        *ContradictionError // why the last collapse failed, if it did
 }
 
 // feed directly with tiles pre-fabricated by the caller
@@ -20,6 +42,18 @@ func NewWaveFromTileset(tileset image.Image,
 	width, height, cellsize, checkpoints int) Wave {
 
 	wave := Wave{
+		Model: Model{
+			Name:     ModelSimple,
+			Rules:    RulesEdges,
+			Variants: VariantsNone,
+			Edges:    NewEdgeMatcher(checkpoints),
+		},
+		Heuristic:     HeuristicEntropy,
+		Strategy:      StrategyBacktrack,
+		Solver:        SolverWFC,
+		Periodic:      PeriodicNone,
+		Retries:       DefaultRetries,
+		RestartMode:   RestartFixed,
 		Width:         width,
 		Height:        height,
 		Cellsize:      cellsize,
@@ -27,20 +61,32 @@ func NewWaveFromTileset(tileset image.Image,
 		OutputTilemap: NewTilemap(width, height),
 	}
 
+	wave.SetSeed(time.Now().UnixNano())
 	wave.SetupSuperpositionTileset(tileset)
+	wave.SetupAdjacency()
 
-	// FIXME: this is the point where we could pre-populate!
+	// there's no LDTK level to pre-populate from in this mode
 	wave.OutputTilemap.Populate(wave.Superposition)
 
 	return wave
 }
 
-func NewWaveFromProject(projectname, level string, width, height, checkpoints int) (*Wave, error) {
+func NewWaveFromProject(projectname, level, seedlevel string,
+	width, height, checkpoints int, model Model) (*Wave, error) {
 
 	wave := &Wave{
+		Model:       model,
+		Heuristic:   HeuristicEntropy,
+		Strategy:    StrategyBacktrack,
+		Solver:      SolverWFC,
+		Periodic:    PeriodicNone,
+		Retries:     DefaultRetries,
+		RestartMode: RestartFixed,
 		Checkpoints: checkpoints,
 		Width:       width,
 		Height:      height,
+		Level:       level,
+		Seedlevel:   seedlevel,
 	}
 
 	project, err := LDTKLoadProjectFile(projectname)
@@ -48,15 +94,39 @@ func NewWaveFromProject(projectname, level string, width, height, checkpoints in
 		return nil, err
 	}
 
+	wave.Project = project
+
+	// the checkpoints have always been a parameter of their own
+	wave.Model.Edges.Checkpoints = checkpoints
+
+	if model.RuleFile != "" {
+		wave.RuleFile, err = LoadRuleFile(model.RuleFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	wave.Cellsize = LDTKGetCellsize(project, level)
 
 	wave.OutputTilemap = NewTilemap(wave.Width, wave.Height)
+	wave.SetSeed(time.Now().UnixNano())
 
-	wave.SetupSuperpositionLDTK(project, level)
+	if err := wave.SetupSuperpositionLDTK(project, level); err != nil {
+		return nil, err
+	}
+
+	if err := wave.SetupAdjacency(); err != nil {
+		return nil, err
+	}
 
-	// FIXME: this is the point where we could pre-populate!
 	wave.OutputTilemap.Populate(wave.Superposition)
 
+	if seedlevel != "" {
+		if err := wave.Prepopulate(seedlevel); err != nil {
+			return nil, err
+		}
+	}
+
 	return wave, nil
 }
 
@@ -65,6 +135,8 @@ func NewWaveFromProject(projectname, level string, width, height, checkpoints in
 func (wave *Wave) SetupSuperpositionTileset(tileset image.Image) error {
 	width := tileset.Bounds().Dx()
 	height := tileset.Bounds().Dy()
+	columns := width / wave.Cellsize
+	registry := map[string]*Tile{}
 
 	for y := 0; y < height; y += wave.Cellsize {
 		for x := 0; x < width; x += wave.Cellsize {
@@ -80,11 +152,28 @@ func (wave *Wave) SetupSuperpositionTileset(tileset image.Image) error {
 			}
 
 			if !ImageIsTransparent(tileimage) {
-				tile, err := NewTile(tileimage, wave.Checkpoints)
+				id, err := GetImageHash(tileimage)
+				if err != nil {
+					return err
+				}
+
+				if Exists(registry, id) {
+					// identical tile drawn twice, count it
+					registry[id].Weight++
+					continue
+				}
+
+				tile, err := NewTile(tileimage, &wave.Model.Edges)
 				if err != nil {
 					return err
 				}
 
+				registry[id] = tile
+
+				// same tile id as LDTK would assign
+				tile.TileId = (y/wave.Cellsize)*columns + x/wave.Cellsize
+				tile.Src = Point{X: x, Y: y}
+
 				wave.Superposition = append(wave.Superposition, tile)
 			}
 		}
@@ -95,19 +184,298 @@ func (wave *Wave) SetupSuperpositionTileset(tileset image.Image) error {
 
 // Same thing, but use an LDTK project file as the source
 func (wave *Wave) SetupSuperpositionLDTK(project *LDTKProject, level string) error {
-	superposition, err := LDTKLoadLevel(project, level, wave.Checkpoints)
+	superposition, sample, err := LDTKLoadLevel(project, level, &wave.Model.Edges)
 	if err != nil {
 		return err
 	}
 
 	wave.Superposition = superposition
+	wave.Sample = sample
+
+	if wave.RuleFile != nil {
+		if err := wave.RuleFile.ApplySockets(superposition); err != nil {
+			return err
+		}
+	}
+
+	// sockets may come from both LDTK and the rule file
+	if err := CheckSockets(superposition); err != nil {
+		return fmt.Errorf("level %s: %w", level, err)
+	}
+
+	// rotated variants never appear in the sample, so they can only be
+	// used with rules learned from the edges
+	if wave.Model.Name == ModelSimple && wave.Model.Rules == RulesEdges {
+		wave.Superposition, err = AddVariants(wave.Superposition,
+			wave.Model.Variants, wave.Model.FlipsOnly, &wave.Model.Edges)
+		if err != nil {
+			return err
+		}
+	}
+
+	if wave.Model.Name == ModelSimple {
+		wave.Model.Edges.Classify(wave.Superposition)
+	}
+
+	if wave.Model.Name == ModelOverlap {
+		tiles := NewVariantTiles(superposition, wave.Model.FlipsOnly, &wave.Model.Edges)
+
+		patterns, counts, err := ExtractPatterns(sample, wave.Model.PatternSize, wave.Model.Symmetry, tiles)
+		if err != nil {
+			return fmt.Errorf("failed to learn patterns from level %s: %w", level, err)
+		}
+
+		wave.Superposition = NewOverlapSuperposition(tiles.Tiles, patterns, counts)
+	}
+
+	return nil
+}
+
+// Number the tiles  of the superposition and build the adjacency index
+// from their constraints, must be called after SetupSuperposition*()
+func (wave *Wave) SetupAdjacency() error {
+	for index, tile := range wave.Superposition {
+		tile.Index = index
+	}
+
+	switch wave.Model.Name {
+	case ModelOverlap:
+		wave.Adjacency = NewAdjacencyFromPatterns(wave.Superposition, wave.Model.PatternSize)
+	default:
+		switch wave.Model.Rules {
+		case RulesSample:
+			wave.Adjacency = NewAdjacencyFromSample(wave.Sample, len(wave.Superposition))
+		case RulesBoth:
+			wave.Adjacency = NewAdjacencyFromSample(wave.Sample, len(wave.Superposition))
+			wave.Adjacency.Intersect(NewAdjacencyFromConstraints(wave.Superposition))
+		default:
+			wave.Adjacency = NewAdjacencyFromConstraints(wave.Superposition)
+		}
+	}
+	if wave.RuleFile != nil {
+		if err := wave.RuleFile.ApplyAllow(wave.Superposition, wave.Adjacency); err != nil {
+			return err
+		}
+	}
+
+	wave.OutputTilemap.Adjacency = wave.Adjacency
+
+	return nil
+}
+
+// Compare the tile edges using the given matcher (simple model only):
+// the constraints of all tiles without sockets are sampled again, the
+// adjacency is rebuilt and the output map is set up again.
+func (wave *Wave) SetEdgeMatcher(matcher EdgeMatcher) error {
+	if wave.Model.Name != ModelSimple {
+		return errors.New("edge matchers are only used by the simple model")
+	}
+
+	wave.Model.Edges = matcher
+	wave.Checkpoints = matcher.Checkpoints
+
+	for _, tile := range wave.Superposition {
+		if tile.Sockets {
+			continue
+		}
+
+		for i, direction := range Directions {
+			tile.Constraints[i] = wave.Model.Edges.Constraint(tile.Image, direction)
+		}
+	}
+
+	wave.Model.Edges.Classify(wave.Superposition)
+
+	if err := wave.SetupAdjacency(); err != nil {
+		return err
+	}
+
+	wave.OutputTilemap.Populate(wave.Superposition)
+
+	if wave.Seedlevel != "" {
+		return wave.Prepopulate(wave.Seedlevel)
+	}
+
+	return nil
+}
+
+// Pin  all tiles  painted  in  the given  LDTK  level  into  the
+// matching slots  of the output map  and propagate their constraints
+// to the rest of the map. Tiles outside the output map are ignored.
+func (wave *Wave) Prepopulate(seedlevel string) error {
+	return wave.PrepopulateExcept(seedlevel, nil)
+}
+
+// Same as Prepopulate(), but the cells of region (if any) are left
+// alone, so that they are being generated anew. Empty cells outside of
+// the region are masked out, so they stay empty.
+func (wave *Wave) PrepopulateExcept(seedlevel string, region *Mask) error {
+	tiles, err := LDTKLoadSeedTiles(wave.Project, seedlevel)
+	if err != nil {
+		return err
+	}
+
+	if region != nil {
+		previous := wave.OutputTilemap.Mask
+
+		mask := NewMask(wave.Width, wave.Height, wave.Width, wave.Height, func(x, y int) bool {
+			point := Point{X: x, Y: y}
+
+			if previous != nil && !previous.Used(point) {
+				return false
+			}
+
+			return region.Used(point) || Exists(tiles, point)
+		})
+
+		wave.OutputTilemap.Mask = mask
+		wave.OutputTilemap.Populate(wave.Superposition)
+	}
+
+	for y := 0; y < wave.Height; y++ {
+		for x := 0; x < wave.Width; x++ {
+			point := Point{X: x, Y: y}
+
+			// tiles in masked cells are ignored as well
+			if !Exists(tiles, point) || !Exists(wave.OutputTilemap.Slots, point) {
+				continue
+			}
+
+			if region != nil && region.Used(point) {
+				continue
+			}
+
+			if err := wave.OutputTilemap.Pin(point, tiles[point]); err != nil {
+				return fmt.Errorf("failed to pin tile from level %s: %w", seedlevel, err)
+			}
+		}
+	}
+
+	if err := wave.OutputTilemap.Propagate(); err != nil {
+		return fmt.Errorf("tiles of level %s contradict each other: %w", seedlevel, err)
+	}
+
+	return nil
+}
+
+// (Re-)initialize the random number generator of the wave, the same
+// seed always leads to the same output
+func (wave *Wave) SetSeed(seed int64) {
+	wave.Seed = seed
+	wave.Rand = rand.New(rand.NewSource(seed))
+	wave.OutputTilemap.Rand = wave.Rand
+	wave.OutputTilemap.Stats.Seed = seed
+}
+
+// Override the weights of the tiles  with the given LDTK tile ids,
+// e.g. from the commandline
+func (wave *Wave) SetWeights(weights map[int]float64) error {
+	for tileid, weight := range weights {
+		found := false
+
+		for _, tile := range wave.Superposition {
+			if tile.TileId == tileid {
+				tile.Weight = weight
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("tile %d is not part of the superposition", tileid)
+		}
+	}
 
 	return nil
 }
 
 // Collapse the wave
-func (wave *Wave) Collapse(retries int) error {
-	return wave.OutputTilemap.Collapse(retries)
+func (wave *Wave) Collapse() error {
+	return wave.CollapseContext(context.Background())
+}
+
+// Collapse the wave, give up if the context is done or the timeout of
+// the wave has been reached. If an attempt fails, start over from the
+// initial (possibly pre-populated) state up to wave.Restarts times.
+func (wave *Wave) CollapseContext(ctx context.Context) error {
+	tilemap := &wave.OutputTilemap
+	tilemap.Heuristic = wave.Heuristic
+	tilemap.Strategy = wave.Strategy
+	tilemap.Periodic = wave.Periodic
+
+	// pre-populated tiles now constrain the opposite edge as well
+	if wave.Periodic != PeriodicNone {
+		if err := tilemap.Propagate(); err != nil {
+			if wave.Seedlevel != "" {
+				return fmt.Errorf("%w: tiles of level %s contradict each other across the map edge: %s",
+					ErrUnsatisfiable, wave.Seedlevel, err)
+			}
+
+			return fmt.Errorf("%w: the rules can't wrap around on axis %s: %s",
+				ErrUnsatisfiable, wave.Periodic, err)
+		}
+	}
+
+	if wave.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wave.Timeout)
+		defer cancel()
+	}
+
+	initial := tilemap.Snapshot()
+	seed := wave.Seed
+	retries := wave.Retries
+
+	for attempt := 0; ; attempt++ {
+		tilemap.Stats.Attempts++
+
+		err := NewSolver(wave.Solver, retries).Solve(ctx, tilemap)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil || errors.Is(err, ErrUnsatisfiable) || attempt >= wave.Restarts {
+			// the sockets of patterns are pixel hashes, unrelated to
+			// their adjacency
+			if errors.As(err, &wave.Contradiction) && wave.Model.Name != ModelSimple {
+				for i := range wave.Contradiction.Neighbors {
+					wave.Contradiction.Neighbors[i].Sockets = nil
+				}
+			}
+
+			return fmt.Errorf("giving up after %d attempt(s): %w", attempt+1, err)
+		}
+
+		if !tilemap.Quiet {
+			fmt.Printf("attempt %d failed: %s\n", attempt+1, err)
+		}
+
+		tilemap.Restore(initial)
+
+		switch wave.RestartMode {
+		case RestartReseed:
+			wave.SetSeed(DeriveSeed(seed, attempt+1))
+		case RestartBackoff:
+			wave.SetSeed(DeriveSeed(seed, attempt+1))
+			retries = max(retries, 1) * 2
+		}
+	}
+}
+
+// Search up to limit solutions  using the CSP solver and call found
+// with each one, e.g. to export it. Returns the number of solutions.
+func (wave *Wave) Enumerate(ctx context.Context, limit int, found func(solution int) error) (int, error) {
+	if wave.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wave.Timeout)
+		defer cancel()
+	}
+
+	wave.OutputTilemap.Periodic = wave.Periodic
+	wave.OutputTilemap.Stats.Attempts++
+
+	solver := &CSPSolver{}
+
+	return solver.Enumerate(ctx, &wave.OutputTilemap, limit, found)
 }
 
 func (wave *Wave) Export(filename string) error {
@@ -116,7 +484,8 @@ func (wave *Wave) Export(filename string) error {
 
 	renderto := image.NewRGBA(image.Rectangle{upLeft, lowRight})
 
-	for point, slot := range wave.OutputTilemap.Slots {
+	for _, slot := range wave.OutputTilemap.Slotlist {
+		point := slot.Position
 		bounds := image.Rect(
 			point.X*wave.Cellsize, point.Y*wave.Cellsize,
 			(point.X+1)*wave.Cellsize, (point.Y+1)*wave.Cellsize,
@@ -125,11 +494,31 @@ func (wave *Wave) Export(filename string) error {
 		if slot.Count() == 1 {
 			tile := slot.GetTile().Image
 			draw.Draw(renderto, bounds, tile, image.ZP, draw.Over)
-		} else {
+		} else if wave.Contradiction == nil {
 			red := color.RGBA{255, 0, 0, 255}
 			draw.Draw(renderto, bounds, &image.Uniform{red}, image.ZP, draw.Src)
 		}
 	}
 
+	// show what went wrong instead of plain red slots
+	if wave.Contradiction != nil {
+		wave.Contradiction.Highlight(renderto, wave.Cellsize, &wave.OutputTilemap)
+	}
+
 	return SavePNG(filename, renderto)
 }
+
+// Add the collapsed wave as a new level to the LDTK project we loaded
+// the example level from and write the project back to disk.
+func (wave *Wave) ExportLDTK(identifier string) error {
+	if wave.Project == nil {
+		return errors.New("wave has not been loaded from an LDTK project")
+	}
+
+	err := LDTKAddLevel(wave.Project, wave.Level, identifier, &wave.OutputTilemap, wave.Cellsize)
+	if err != nil {
+		return err
+	}
+
+	return LDTKSaveProject(wave.Project)
+}
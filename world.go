@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+/*
+A world is a  grid of levels generated in one go. The wave covers the
+whole world, so that the edges of neighboring levels match, and is
+split into levels when written into the project. The levels are named
+<prefix>_<column>_<row> and placed next to each other in the world,
+starting at a free spot.
+*/
+type World struct {
+	Columns, Rows int
+}
+
+// parse a world size <columns>x<rows>, e.g. 3x2
+func ParseWorld(spec string) (World, error) {
+	columns, rows, found := strings.Cut(strings.ToLower(spec), "x")
+	if !found {
+		return World{}, fmt.Errorf("invalid world %q, expected <columns>x<rows>", spec)
+	}
+
+	world := World{}
+	var errc, errr error
+
+	world.Columns, errc = strconv.Atoi(columns)
+	world.Rows, errr = strconv.Atoi(rows)
+
+	if errc != nil || errr != nil || world.Columns < 1 || world.Rows < 1 {
+		return World{}, fmt.Errorf("invalid world %q, expected <columns>x<rows>", spec)
+	}
+
+	return world, nil
+}
+
+// Return the identifier of the level at the given grid position
+func (world World) LevelName(prefix string, column, row int) string {
+	return fmt.Sprintf("%s_%d_%d", prefix, column, row)
+}
+
+// Return a tilemap holding the slots of  the given section of the map,
+// moved to the origin. The slots are shared, not copied.
+func (tilemap *Tilemap) Section(x, y, width, height int) *Tilemap {
+	section := NewTilemap(width, height)
+
+	for row := 0; row < height; row++ {
+		for column := 0; column < width; column++ {
+			slot, ok := tilemap.Slots[Point{X: x + column, Y: y + row}]
+			if !ok {
+				continue
+			}
+
+			moved := *slot
+			moved.Position = Point{X: column, Y: row}
+
+			section.Slots[moved.Position] = &moved
+			section.Slotlist = append(section.Slotlist, &moved)
+		}
+	}
+
+	return &section
+}
+
+// Split the collapsed wave into the levels of the world and add them
+// to the LDTK project we loaded the example level from
+func (wave *Wave) ExportLDTKWorld(prefix string, world World) error {
+	if wave.Project == nil {
+		return errors.New("wave has not been loaded from an LDTK project")
+	}
+
+	width := wave.Width / world.Columns
+	height := wave.Height / world.Rows
+	pxwidth := width * wave.Cellsize
+	pxheight := height * wave.Cellsize
+
+	if gjson.GetBytes(wave.Project.Data, "worldLayout").String() == "GridVania" {
+		gridwidth := int(gjson.GetBytes(wave.Project.Data, "worldGridWidth").Int())
+		gridheight := int(gjson.GetBytes(wave.Project.Data, "worldGridHeight").Int())
+
+		if gridwidth > 0 && gridheight > 0 && (pxwidth%gridwidth != 0 || pxheight%gridheight != 0) {
+			return fmt.Errorf("level size %dx%d px doesn't fit the world grid of %dx%d px",
+				pxwidth, pxheight, gridwidth, gridheight)
+		}
+	}
+
+	originx, originy := LDTKFreeWorldPosition(wave.Project.Data)
+
+	for row := 0; row < world.Rows; row++ {
+		for column := 0; column < world.Columns; column++ {
+			section := wave.OutputTilemap.Section(column*width, row*height, width, height)
+
+			// linear layouts don't use coordinates at all
+			worldx, worldy := originx, originy
+			if originx >= 0 {
+				worldx += column * pxwidth
+				worldy += row * pxheight
+			}
+
+			err := LDTKAddLevelAt(wave.Project, wave.Level, world.LevelName(prefix, column, row),
+				section, wave.Cellsize, worldx, worldy)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return LDTKSaveProject(wave.Project)
+}